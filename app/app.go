@@ -1,13 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/signal"
 	"p2faster/peer"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/test"
 	"fyne.io/fyne/v2/widget"
 	logging "github.com/ipfs/go-log/v2"
@@ -22,10 +29,27 @@ type App struct {
 	trans         *peer.Transmission
 	msgDispatcher *MsgDispatch
 	recvFile      chan bool
+	offerLock     sync.Mutex
+	recvOffer     *SendFile
+	recvPath      string
+	receiving     atomic.Bool
+	sendManifest  *peer.DirManifest
+	sendDelta     bool
+	sendLog       *transferLog
 	side          int
+	contacts      map[string]peer.Contact
+	members       map[string]string
 
 	app               fyne.App
+	window            fyne.Window
 	localIdLabel      *widget.Entry
+	peerIdEntry       *widget.Entry
+	lanBox            *fyne.Container
+	contactSelect     *widget.Select
+	namespaceEntry    *widget.Entry
+	memberSelect      *widget.Select
+	sasLabel          *widget.Label
+	verifyButton      *widget.Button
 	filePathEntry     *widget.Entry
 	connectSteteLabel *widget.Label
 	sendButton        *widget.Button
@@ -43,19 +67,57 @@ func (a *App) Start() {
 	a.recvFile = make(chan bool)
 	a.side = SERVER
 
-	a.conn = peer.CreateBinaryConn(
+	config, err := peer.LoadConfig(filepath.Join(peer.ConfigDir(), "config.json"))
+	if err != nil {
+		log.Errorf("load config failed, use the defaults. err:%v", err)
+		config = peer.DefaultConfig()
+	}
+
+	a.conn = peer.CreateBinaryConnWithConfig(
+		config,
 		a.onSendStream,
 		a.onChatStream,
 		a.onLocalId,
 	)
-
-	a.conn.Init()
+	a.conn.SetLanPeerHandler(a.onLanPeers)
+	a.conn.SetConfirmHandler(a.onConfirmPeer)
+	a.conn.SetOfflineFileHandler(a.onOfflineFile)
+	a.conn.SetSyncHandler(a.onSyncEvent)
+
+	if err := a.conn.Init(); err != nil {
+		log.Errorf("init connection failed. err:%v", err)
+		a.errorUI(err)
+		return
+	}
 
 	a.mainUI()
+	a.close()
+}
+
+// close says bye to the peer and closes the connection once the window is
+// gone, transfers in flight get peer.CloseTimeout to finish.
+func (a *App) close() {
+	if a.msgDispatcher != nil {
+		a.msgDispatcher.Bye()
+	}
+	if err := a.conn.Close(); err != nil {
+		log.Errorf("close connection failed. err:%v", err)
+	}
+}
+
+func (a *App) quitOnSignal() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Infof("get a stop signal, quit.")
+	a.app.Quit()
 }
 
 func (a *App) onChatStream(s network.Stream) {
 	a.msgDispatcher = CreateMsgDispatch(s, a.side, a.onRecvFile, a.onSendFile)
+	a.msgDispatcher.SetVerifyHandler(a.onVerify)
+	a.msgDispatcher.SetCloseHandler(a.onPeerClose)
+	a.msgDispatcher.SetDoneHandler(a.onSendDone)
 	a.sendButton.Enable()
 	a.recvButton.Enable()
 
@@ -65,14 +127,67 @@ func (a *App) onChatStream(s network.Stream) {
 	a.msgDispatcher.Start()
 }
 
+func (a *App) onPeerClose() {
+	a.sendButton.Disable()
+	a.recvButton.Disable()
+	a.connectSteteLabel.SetText("disconnected")
+	a.connectSteteLabel.Refresh()
+}
+
 func (a *App) onSendStream(s network.Stream) {
+	if !a.receiving.CompareAndSwap(false, true) {
+		log.Infof("refuse send stream, already receiving.")
+		s.Reset()
+		return
+	}
+
+	// the data of an offer is only taken once, after the user accepted it
+	offer, path := a.takeOffer()
+	if offer == nil {
+		log.Infof("refuse send stream, no accepted offer.")
+		a.receiving.Store(false)
+		s.Reset()
+		return
+	}
+
 	trans := peer.CreateTransmission(s)
-	go trans.RecvFile(a.filePathEntry.Text)
+	trans.SetRateLimiter(a.conn.RateLimiter())
+	trans.SetFileMeta(offer.Meta, a.conn.MetadataPolicy())
+	if offer.Stream {
+		a.conn.LimitStream(trans, path)
+	} else {
+		a.conn.LimitReceive(trans, int64(offer.Size))
+	}
+	record := startLog(a.conn, peer.TransferReceive, path, offer)
+	record.begin(trans)
+	go func() {
+		defer a.receiving.Store(false)
+		var err error
+		switch {
+		case offer.Stream:
+			err = receiveStream(trans, path)
+		case offer.Dir:
+			err = trans.RecvDir(path)
+		case offer.Delta:
+			err = trans.RecvFileDelta(path)
+		default:
+			err = trans.RecvFile(path)
+		}
+		code, msg := errorCode(err)
+		a.msgDispatcher.Done(code, msg)
+		record.finish(code, msg)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("receive failed, %s", codeReason(code, msg)), a.window)
+		} else if !offer.Stream && !offer.Dir {
+			a.conn.StoreChunks(path)
+		}
+	}()
 }
 
-func (a *App) onSendFile(recv bool) {
-	if !recv {
-		label := widget.NewLabel("peer cancel recv.")
+func (a *App) onSendFile(code int, msg string) {
+	if code != CODE_OK {
+		a.sendLog.finish(code, msg)
+		label := widget.NewLabel("peer refused the file, " + codeReason(code, msg))
 		pop := widget.NewModalPopUp(label, test.Canvas())
 		pop.Show()
 		return
@@ -81,14 +196,54 @@ func (a *App) onSendFile(recv bool) {
 	rw, err := a.conn.CreateSendStream()
 	if err != nil {
 		log.Errorf("create send file stream faied. err:%v", err)
+		a.sendLog.finish(CODE_INTERNAL, err.Error())
+		dialog.ShowError(err, a.window)
 		return
 	}
 
 	trans := peer.CreateTransmission(rw)
-	trans.SendFile(a.filePathEntry.Text)
+	trans.SetRateLimiter(a.conn.RateLimiter())
+	a.sendLog.begin(trans)
+	switch {
+	case a.sendManifest != nil:
+		err = trans.SendDir(a.filePathEntry.Text, a.sendManifest)
+	case a.sendDelta:
+		err = trans.SendFileDelta(a.filePathEntry.Text)
+	default:
+		err = trans.SendFile(a.filePathEntry.Text)
+	}
+	if err != nil {
+		a.sendLog.finish(CODE_INTERNAL, err.Error())
+		dialog.ShowError(fmt.Errorf("send failed: %w", err), a.window)
+	}
+}
+
+// onSendDone shows the outcome the receiver reports.
+func (a *App) onSendDone(code int, msg string) {
+	a.sendLog.finish(code, msg)
+	if code == CODE_OK {
+		dialog.ShowInformation("send", "the peer received the file.", a.window)
+		return
+	}
+	dialog.ShowError(fmt.Errorf("peer failed to receive the file, %s", codeReason(code, msg)), a.window)
 }
 
-func (a *App) onRecvFile(name string, size int) bool {
+func (a *App) onRecvFile(file *SendFile) (int, string) {
+	// a new offer replaces the one accepted before and not sent yet
+	a.takeOffer()
+	if !a.conn.TransferAllowed(a.conn.PeerId()) {
+		log.Infof("refuse file from unverified peer. name:%s", file.FileName)
+		return CODE_DECLINED, "peer not verified"
+	}
+	if a.receiving.Load() {
+		return CODE_BUSY, ""
+	}
+	// refuse at once what can not fit wherever it is saved
+	if err := a.conn.CheckReceive(a.receiveDir(), int64(file.Size)); err != nil {
+		log.Infof("refuse file. name:%s, err:%v", file.FileName, err)
+		return errorCode(err)
+	}
+
 	a.sendBox.Hide()
 	a.recvBox.Show()
 	a.cancelButton.Enable()
@@ -101,8 +256,54 @@ func (a *App) onRecvFile(name string, size int) bool {
 	a.cancelButton.Disable()
 	a.recvButton.Disable()
 
-	// TODO check local file path
-	return recv
+	if !recv {
+		return CODE_DECLINED, ""
+	}
+	path := a.filePathEntry.Text
+	err := peer.CheckDestination(path, file.Dir)
+	if err == nil {
+		err = a.conn.CheckReceive(path, int64(file.Size))
+	}
+	if err != nil {
+		log.Infof("refuse file. path:%s, err:%v", path, err)
+		dialog.ShowError(err, a.window)
+		return errorCode(err)
+	}
+	a.offerLock.Lock()
+	a.recvOffer, a.recvPath = file, path
+	a.offerLock.Unlock()
+	return CODE_OK, ""
+}
+
+// takeOffer returns the accepted offer and where to save it, and clears
+// it. The offer is nil when none is pending.
+func (a *App) takeOffer() (*SendFile, string) {
+	a.offerLock.Lock()
+	defer a.offerLock.Unlock()
+	offer, path := a.recvOffer, a.recvPath
+	a.recvOffer, a.recvPath = nil, ""
+	return offer, path
+}
+
+// receiveDir is where the file is likely saved before the user picks it.
+func (a *App) receiveDir() string {
+	if a.filePathEntry.Text == "" {
+		return "."
+	}
+	return a.filePathEntry.Text
+}
+
+// receiveStream saves a stream of unknown length in the file at path.
+func receiveStream(trans *peer.Transmission, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := trans.RecvStream(f); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 func (a *App) onLocalId(id string) {
@@ -113,11 +314,28 @@ func (a *App) onLocalId(id string) {
 	}
 }
 
+func (a *App) onLanPeers(peers []peer.LanPeer) {
+	if a.lanBox == nil {
+		return
+	}
+
+	a.lanBox.Objects = nil
+	for _, p := range peers {
+		id := p.ID
+		a.lanBox.Add(widget.NewButton(fmt.Sprintf("%s (%s)", p.Name, shortId(id)), func() {
+			a.peerIdEntry.SetText(id)
+			a.onConnButton(id)
+		}))
+	}
+	a.lanBox.Refresh()
+}
+
 func (a *App) onConnButton(peerId string) {
 	s, err := a.conn.Connect(peerId)
 	if err != nil {
 		a.connectSteteLabel.SetText("disconnected")
 		a.connectSteteLabel.Refresh()
+		dialog.ShowError(err, a.window)
 		return
 	}
 	a.side = CLIENT
@@ -126,26 +344,36 @@ func (a *App) onConnButton(peerId string) {
 
 func (a *App) mainUI() {
 	a.app = app.New()
+	go a.quitOnSignal()
 	w := a.app.NewWindow("p2faster")
 	w.SetMaster()
+	a.window = w
 
 	localIdTip := widget.NewLabel("local ID:")
 	a.localIdLabel = widget.NewEntryWithData(binding.BindString(&a.localId))
 	a.localIdLabel.Disable()
 	localId := container.NewGridWithColumns(1, localIdTip, a.localIdLabel)
 
-	peerIdLabel := widget.NewLabel("peer ID:")
-	peerIdEntry := widget.NewEntry()
-	peerId := container.NewGridWithColumns(1, peerIdLabel, peerIdEntry)
+	peerIdLabel := widget.NewLabel("peer ID or address:")
+	a.peerIdEntry = widget.NewEntry()
+	peerId := container.NewGridWithColumns(1, peerIdLabel, a.peerIdEntry)
+	contacts := a.contactsUI()
+	namespace := a.namespaceUI()
+
+	lanLabel := widget.NewLabel("nearby peers:")
+	a.lanBox = container.NewVBox()
+	a.onLanPeers(a.conn.LanPeers())
+	lanPeers := container.NewVBox(lanLabel, a.lanBox)
 
 	connectButton := widget.NewButton("connect", func() {
-		a.onConnButton(peerIdEntry.Text)
+		a.onConnButton(a.peerIdEntry.Text)
 	})
 
 	connectSteteLabel := widget.NewLabel("connect state:")
 	a.connectSteteLabel = widget.NewLabel("disconnected")
 	connectStete := container.NewGridWithColumns(2, connectSteteLabel, a.connectSteteLabel)
 	connection := container.NewGridWithColumns(2, connectButton, connectStete)
+	verify := a.verifyUI()
 
 	filePathLabel := widget.NewLabel("file path:")
 	a.filePathEntry = widget.NewEntry()
@@ -172,20 +400,65 @@ func (a *App) mainUI() {
 			pop.Show()
 			return
 		}
-		a.msgDispatcher.ConferSendFile(fileInfo.Name(), int(fileInfo.Size()))
+		meta, err := peer.ReadFileMeta(a.filePathEntry.Text, a.conn.MetadataPolicy())
+		if err != nil {
+			log.Errorf("read file metadata failed. err:%v", err)
+		}
+		offer := &SendFile{FileName: fileInfo.Name(), Size: int(fileInfo.Size()), Meta: meta}
+		if !fileInfo.IsDir() {
+			a.sendManifest = nil
+			offer.Delta = a.sendDelta
+			a.sendLog = startLog(a.conn, peer.TransferSend, a.filePathEntry.Text, offer)
+			a.msgDispatcher.ConferSendFile(offer)
+			return
+		}
+
+		manifest, err := peer.BuildDirManifest(a.filePathEntry.Text, a.conn.LinkPolicy(), a.conn.MetadataPolicy())
+		if err != nil {
+			log.Errorf("read directory failed. err:%v", err)
+			dialog.ShowError(err, a.window)
+			return
+		}
+		a.sendManifest = manifest
+		offer.Dir, offer.Size = true, int(manifest.Size())
+		a.sendLog = startLog(a.conn, peer.TransferSend, a.filePathEntry.Text, offer)
+		a.msgDispatcher.ConferSendFile(offer)
 	})
 	a.sendButton.Disable()
-	a.sendBox = container.NewVBox(a.sendButton)
+	// a delta only sends what changed since the copy the peer already has
+	a.sendDelta = a.conn.DeltaSync()
+	delta := widget.NewCheck("delta", func(on bool) { a.sendDelta = on })
+	delta.SetChecked(a.sendDelta)
+	a.sendBox = container.NewVBox(a.sendButton, delta, a.offlineUI(), a.syncUI(), a.historyUI(), a.bandwidthUI())
 
 	sendGrid := container.NewGridWithColumns(2, filePath, a.sendBox, a.recvBox)
 
 	w.SetContent(container.NewVBox(
 		localId,
 		peerId,
+		contacts,
+		namespace,
+		lanPeers,
 		connection,
+		verify,
 		sendGrid))
 	w.Resize(fyne.NewSize(460, 360))
 	w.FixedSize()
 
 	w.ShowAndRun()
 }
+
+// errorUI only shows why p2faster could not start.
+func (a *App) errorUI(err error) {
+	a.app = app.New()
+	w := a.app.NewWindow("p2faster")
+	w.SetContent(widget.NewLabel(fmt.Sprintf("failed to start: %v", err)))
+	w.ShowAndRun()
+}
+
+func shortId(id string) string {
+	if len(id) <= 12 {
+		return id
+	}
+	return id[:6] + ".." + id[len(id)-6:]
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+func (a *App) bandwidthUI() fyne.CanvasObject {
+	return widget.NewButton("bandwidth", a.onBandwidthButton)
+}
+
+// onBandwidthButton edits the rate limits in KiB/s, transfers in flight
+// follow the new limits at once. The schedule from the config is kept.
+func (a *App) onBandwidthButton() {
+	limiter := a.conn.RateLimiter()
+	limits := limiter.Limits()
+
+	upload := kibEntry(limits.Upload)
+	download := kibEntry(limits.Download)
+	transferUpload := kibEntry(limits.TransferUpload)
+	transferDownload := kibEntry(limits.TransferDownload)
+	items := []*widget.FormItem{
+		widget.NewFormItem("upload KiB/s", upload),
+		widget.NewFormItem("download KiB/s", download),
+		widget.NewFormItem("per transfer upload", transferUpload),
+		widget.NewFormItem("per transfer download", transferDownload),
+	}
+	dialog.ShowForm("bandwidth limits, empty is unlimited", "apply", "cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		var err error
+		for _, field := range []struct {
+			entry *widget.Entry
+			rate  *int64
+		}{
+			{upload, &limits.Upload},
+			{download, &limits.Download},
+			{transferUpload, &limits.TransferUpload},
+			{transferDownload, &limits.TransferDownload},
+		} {
+			if *field.rate, err = parseKib(field.entry.Text); err != nil {
+				dialog.ShowError(err, a.window)
+				return
+			}
+		}
+		if err := limiter.SetLimits(limits); err != nil {
+			dialog.ShowError(err, a.window)
+		}
+	}, a.window)
+}
+
+func kibEntry(bytesPerSecond int64) *widget.Entry {
+	entry := widget.NewEntry()
+	if bytesPerSecond > 0 {
+		entry.SetText(strconv.FormatInt(bytesPerSecond/1024, 10))
+	}
+	return entry
+}
+
+func parseKib(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return 0, nil
+	}
+	kib, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || kib < 0 {
+		return 0, fmt.Errorf("invalid rate %q, want KiB/s", text)
+	}
+	return kib * 1024, nil
+}
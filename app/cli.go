@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"p2faster/peer"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// runCli runs one transfer from the command line instead of the window:
+//
+//	p2faster send [-config file] [-delta] [-name name] <peer> <path or - for stdin>
+//	p2faster receive [-config file] [-stdout] [path]
+//	p2faster sync [-config file] [-mode both|send|receive] <peer> <folder id> <path>
+//	p2faster history [-config file] [-n count] [-open id] [-resend id]
+//
+// SIGHUP applies the rate limits of the config file again, so they can be
+// changed during a transfer. It returns the exit status, 1 when the transfer
+// fails.
+func runCli(args []string) int {
+	switch args[0] {
+	case "send":
+		return cliSend(args[1:])
+	case "receive":
+		return cliReceive(args[1:])
+	case "sync":
+		return cliSync(args[1:])
+	case "history":
+		return cliHistory(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, use send, receive, sync or history\n", args[0])
+	return 2
+}
+
+// cli is the state of a command line transfer, it ends with the first
+// outcome sent on result.
+type cli struct {
+	conn       *peer.BinaryConn
+	configPath string
+	path       string
+	result     chan *TransferDone
+
+	lock       sync.Mutex
+	dispatcher *MsgDispatch
+	record     *transferLog
+
+	// the offer accepted by the receiver
+	dest      string
+	offer     *SendFile
+	receiving atomic.Bool
+
+	manifest *peer.DirManifest
+	delta    bool
+	// stdin is sent, or what is received goes to stdout
+	stdin  bool
+	stdout bool
+
+	onSync func(peer.SyncEvent)
+}
+
+func createCli(path string) *cli {
+	return &cli{
+		path:   path,
+		result: make(chan *TransferDone, 1),
+	}
+}
+
+func cliSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	configPath := fs.String("config", filepath.Join(peer.ConfigDir(), "config.json"), "json config file")
+	delta := fs.Bool("delta", false, "only send what changed since the copy the peer has, defaults to delta_sync of the config")
+	name := fs.String("name", "stdin", "name offered for the data read from stdin")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: p2faster send [-config file] [-delta] [-name name] <peer> <path or - for stdin>")
+		return 2
+	}
+	target, path := fs.Arg(0), fs.Arg(1)
+
+	c := createCli(path)
+	c.stdin = path == "-"
+	var info os.FileInfo
+	if !c.stdin {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if err := c.init(*configPath, func(s network.Stream) { s.Reset() }, func(network.Stream) {}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer c.conn.Close()
+	if c.stdin {
+		// stdin carries the data, there is no one to ask
+		c.conn.SetConfirmHandler(func(string) bool { return false })
+	}
+
+	s, err := c.conn.Connect(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect %s failed: %v\n", target, err)
+		return 1
+	}
+	d := c.start(s, CLIENT, c.refuseOffer, c.onAnswer)
+	defer d.Bye()
+
+	if c.stdin {
+		offer := &SendFile{FileName: *name, Stream: true}
+		fmt.Fprintf(os.Stderr, "offer %s from stdin to %s\n", offer.FileName, target)
+		c.setRecord(startLog(c.conn, peer.TransferSend, "", offer))
+		d.ConferSendFile(offer)
+		return c.wait()
+	}
+	meta, err := peer.ReadFileMeta(path, c.conn.MetadataPolicy())
+	if err != nil {
+		log.Errorf("read file metadata failed. err:%v", err)
+	}
+	offer := &SendFile{FileName: info.Name(), Size: int(info.Size()), Meta: meta}
+	if info.IsDir() {
+		if c.manifest, err = peer.BuildDirManifest(path, c.conn.LinkPolicy(), c.conn.MetadataPolicy()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		offer.Dir, offer.Size = true, int(c.manifest.Size())
+	} else {
+		c.delta = c.conn.DeltaSync()
+		if flagSet(fs, "delta") {
+			c.delta = *delta
+		}
+		offer.Delta = c.delta
+	}
+	fmt.Fprintf(os.Stderr, "offer %s (%d bytes) to %s\n", offer.FileName, offer.Size, target)
+	c.setRecord(startLog(c.conn, peer.TransferSend, path, offer))
+	d.ConferSendFile(offer)
+	return c.wait()
+}
+
+func cliReceive(args []string) int {
+	fs := flag.NewFlagSet("receive", flag.ContinueOnError)
+	configPath := fs.String("config", filepath.Join(peer.ConfigDir(), "config.json"), "json config file")
+	stdout := fs.Bool("stdout", false, "write the received file or stream to stdout")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	path := "."
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	c := createCli(path)
+	c.stdout = *stdout
+	if err := c.init(*configPath, c.onSendStream, c.onChatStream); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer c.conn.Close()
+	return c.wait()
+}
+
+// cliSync keeps a folder in sync with the folder of the same ID at the peer
+// until interrupted, the folder is saved and synced by later runs too.
+func cliSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	configPath := fs.String("config", filepath.Join(peer.ConfigDir(), "config.json"), "json config file")
+	mode := fs.String("mode", string(peer.SyncBoth), "both, send or receive, the peer must use both or the opposite")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 3 {
+		fmt.Fprintln(os.Stderr, "usage: p2faster sync [-config file] [-mode both|send|receive] <peer> <folder id> <path>")
+		return 2
+	}
+	target, id, path := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+
+	c := createCli(path)
+	c.onSync = func(e peer.SyncEvent) {
+		if e.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", e.Type, e.Path, e.Err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s %s\n", e.Type, e.Path)
+	}
+	if err := c.init(*configPath, func(s network.Stream) { s.Reset() }, func(s network.Stream) { s.Reset() }); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer c.conn.Close()
+
+	peerId, err := c.conn.Dial(target)
+	if peerId == "" {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect %s failed, sync starts once the peer connects: %v\n", target, err)
+	}
+	folders := c.conn.FolderSync()
+	for _, f := range folders.Folders() {
+		if f.ID == id {
+			fmt.Fprintf(os.Stderr, "folder %s is already synced with %s, stop with ctrl-c\n", id, f.Peer)
+			return c.waitSignal()
+		}
+	}
+	if err := folders.Add(peer.SyncFolder{ID: id, Path: path, Peer: peerId, Mode: peer.SyncMode(*mode)}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "sync %s with %s, stop with ctrl-c\n", path, peerId)
+	return c.waitSignal()
+}
+
+func (c *cli) init(configPath string, onFileStream, onChatStream func(network.Stream)) error {
+	config, err := peer.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	c.configPath = configPath
+	c.conn = peer.CreateBinaryConnWithConfig(config, onFileStream, onChatStream, func(id string) {
+		fmt.Fprintf(os.Stderr, "local ID: %s\n", id)
+	})
+	c.conn.SetConfirmHandler(confirmOnStdin)
+	c.conn.SetSyncHandler(c.onSync)
+	return c.conn.Init()
+}
+
+func (c *cli) start(s network.Stream, side int, onServerFile func(*SendFile) (int, string), onClientFile func(int, string)) *MsgDispatch {
+	d := CreateMsgDispatch(s, side, onServerFile, onClientFile)
+	d.SetDoneHandler(c.finish)
+	d.SetCloseHandler(func() { c.finish(CODE_INTERNAL, "peer left") })
+	c.lock.Lock()
+	c.dispatcher = d
+	c.lock.Unlock()
+	d.Start()
+	return d
+}
+
+// finish ends the command with the first outcome, later ones are dropped.
+func (c *cli) finish(code int, msg string) {
+	c.lock.Lock()
+	record := c.record
+	c.lock.Unlock()
+	record.finish(code, msg)
+	select {
+	case c.result <- &TransferDone{Code: code, Msg: msg}:
+	default:
+	}
+}
+
+func (c *cli) wait() int {
+	stop, cancel := c.notify()
+	defer cancel()
+
+	select {
+	case done := <-c.result:
+		if done.Code != CODE_OK {
+			fmt.Fprintf(os.Stderr, "transfer failed, %s\n", codeReason(done.Code, done.Msg))
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "transfer done")
+		return 0
+	case <-stop:
+		fmt.Fprintln(os.Stderr, "interrupted")
+		return 1
+	}
+}
+
+// waitSignal runs until interrupted, for the commands working in the
+// background.
+func (c *cli) waitSignal() int {
+	stop, cancel := c.notify()
+	defer cancel()
+	<-stop
+	return 0
+}
+
+// notify delivers SIGINT and SIGTERM on stop and reloads the rate limits on
+// SIGHUP until cancel.
+func (c *cli) notify() (stop chan os.Signal, cancel func()) {
+	stop = make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hangup:
+				c.reloadLimits()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return stop, func() {
+		signal.Stop(stop)
+		signal.Stop(hangup)
+		close(done)
+	}
+}
+
+// reloadLimits applies the rate limits of the config file to the transfers
+// in flight.
+func (c *cli) reloadLimits() {
+	config, err := peer.LoadConfig(c.configPath)
+	if err == nil {
+		err = c.conn.RateLimiter().SetLimits(config.RateLimits)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reload rate limits failed: %v\n", err)
+		return
+	}
+	limits := config.RateLimits
+	fmt.Fprintf(os.Stderr, "rate limits reloaded, upload %d KiB/s, download %d KiB/s, 0 is unlimited\n", limits.Upload/1024, limits.Download/1024)
+}
+
+func (c *cli) onAnswer(code int, msg string) {
+	if code != CODE_OK {
+		c.finish(code, msg)
+		return
+	}
+	go func() {
+		s, err := c.conn.CreateSendStream()
+		if err != nil {
+			c.finish(CODE_INTERNAL, err.Error())
+			return
+		}
+		trans := peer.CreateTransmission(s)
+		trans.SetRateLimiter(c.conn.RateLimiter())
+		c.record.begin(trans)
+		switch {
+		case c.stdin:
+			err = trans.SendStream(os.Stdin)
+		case c.manifest != nil:
+			err = trans.SendDir(c.path, c.manifest)
+		case c.delta:
+			err = trans.SendFileDelta(c.path)
+		default:
+			err = trans.SendFile(c.path)
+		}
+		if err != nil {
+			c.finish(CODE_INTERNAL, err.Error())
+			return
+		}
+		fmt.Fprintln(os.Stderr, "sent, waiting for the peer to check it")
+	}()
+}
+
+func (c *cli) refuseOffer(*SendFile) (int, string) {
+	return CODE_DECLINED, "the peer is only sending"
+}
+
+func (c *cli) onChatStream(s network.Stream) {
+	c.lock.Lock()
+	busy := c.dispatcher != nil
+	c.lock.Unlock()
+	if busy {
+		log.Infof("refuse second session. peer:%s", s.Conn().RemotePeer())
+		s.Reset()
+		return
+	}
+	c.start(s, SERVER, c.onOffer, func(int, string) {})
+}
+
+// onOffer accepts the offer when it fits at the path given on the command
+// line, a directory path receives it under the offered name.
+func (c *cli) onOffer(file *SendFile) (int, string) {
+	if !c.conn.TransferAllowed(c.conn.PeerId()) {
+		return CODE_DECLINED, "peer not verified"
+	}
+	if c.receiving.Load() {
+		return CODE_BUSY, ""
+	}
+	if c.stdout {
+		return c.onStdoutOffer(file)
+	}
+
+	dest := c.path
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		base := filepath.Base(file.FileName)
+		if base == "." || base == ".." || base == string(filepath.Separator) {
+			msg := fmt.Sprintf("invalid name %q", file.FileName)
+			c.finish(CODE_PATH_REJECTED, msg)
+			return CODE_PATH_REJECTED, msg
+		}
+		dest = filepath.Join(dest, base)
+	}
+	err := peer.CheckDestination(dest, file.Dir)
+	if err == nil {
+		err = c.conn.CheckReceive(dest, int64(file.Size))
+	}
+	if err != nil {
+		code, msg := errorCode(err)
+		c.finish(code, msg)
+		return code, msg
+	}
+
+	c.dest, c.offer = dest, file
+	fmt.Fprintf(os.Stderr, "receive %s (%d bytes) into %s\n", file.FileName, file.Size, dest)
+	return CODE_OK, ""
+}
+
+// onStdoutOffer accepts a stream, or a file that is received aside first
+// so it is only written once verified.
+func (c *cli) onStdoutOffer(file *SendFile) (int, string) {
+	if file.Dir {
+		msg := "a directory can not go to stdout"
+		c.finish(CODE_PATH_REJECTED, msg)
+		return CODE_PATH_REJECTED, msg
+	}
+	if !file.Stream {
+		if err := c.conn.CheckReceive(os.TempDir(), int64(file.Size)); err != nil {
+			code, msg := errorCode(err)
+			c.finish(code, msg)
+			return code, msg
+		}
+	}
+	c.offer = file
+	fmt.Fprintf(os.Stderr, "receive %s to stdout\n", file.FileName)
+	return CODE_OK, ""
+}
+
+func (c *cli) onSendStream(s network.Stream) {
+	if c.offer == nil || !c.receiving.CompareAndSwap(false, true) {
+		s.Reset()
+		return
+	}
+	defer c.receiving.Store(false)
+
+	trans := peer.CreateTransmission(s)
+	trans.SetRateLimiter(c.conn.RateLimiter())
+	trans.SetFileMeta(c.offer.Meta, c.conn.MetadataPolicy())
+	switch {
+	case c.stdout && c.offer.Stream:
+		c.conn.LimitStream(trans, "")
+	case c.offer.Stream:
+		c.conn.LimitStream(trans, c.dest)
+	default:
+		c.conn.LimitReceive(trans, int64(c.offer.Size))
+	}
+	record := startLog(c.conn, peer.TransferReceive, c.dest, c.offer)
+	record.begin(trans)
+	c.setRecord(record)
+	var err error
+	switch {
+	case c.stdout && c.offer.Stream:
+		err = trans.RecvStream(os.Stdout)
+	case c.stdout:
+		err = recvToStdout(trans, c.offer.Delta)
+	case c.offer.Stream:
+		err = receiveStream(trans, c.dest)
+	case c.offer.Dir:
+		err = trans.RecvDir(c.dest)
+	case c.offer.Delta:
+		err = trans.RecvFileDelta(c.dest)
+	default:
+		err = trans.RecvFile(c.dest)
+	}
+	code, msg := errorCode(err)
+	c.lock.Lock()
+	d := c.dispatcher
+	c.lock.Unlock()
+	d.Done(code, msg)
+	// before finish, the process ends with the transfer
+	if err == nil && !c.stdout && !c.offer.Stream && !c.offer.Dir {
+		c.conn.StoreChunks(c.dest)
+	}
+	c.finish(code, msg)
+}
+
+func (c *cli) setRecord(record *transferLog) {
+	c.lock.Lock()
+	c.record = record
+	c.lock.Unlock()
+}
+
+// cliHistory lists the last transfers, opens the folder of one or sends
+// its file again to the same peer.
+func cliHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	configPath := fs.String("config", filepath.Join(peer.ConfigDir(), "config.json"), "json config file")
+	count := fs.Int("n", 20, "number of transfers to list, 0 lists all")
+	open := fs.Uint64("open", 0, "open the folder of the transfer with this id")
+	resend := fs.Uint64("resend", 0, "send the file of the transfer with this id again")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	config, err := peer.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	history := peer.CreateHistory(config.HistoryPath)
+
+	id := *open
+	if *resend != 0 {
+		id = *resend
+	}
+	if id == 0 {
+		records, err := history.List(*count)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for i := range records {
+			fmt.Println(formatRecord(&records[i]))
+		}
+		return 0
+	}
+
+	r, ok, err := history.Get(id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "no transfer %d\n", id)
+		return 1
+	}
+	if *resend == 0 {
+		if err := openFolder(&r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if r.Direction != peer.TransferSend {
+		fmt.Fprintf(os.Stderr, "transfer %d was received, only sends can be sent again\n", id)
+		return 1
+	}
+	return cliSend([]string{"-config", *configPath, r.PeerId, r.Path})
+}
+
+// recvToStdout receives a file in a temporary file and copies it to stdout
+// once its hash is verified.
+func recvToStdout(trans *peer.Transmission, delta bool) error {
+	f, err := os.CreateTemp("", "p2faster-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+
+	// a delta against the empty file is a full send
+	if delta {
+		err = trans.RecvFileDelta(tmp)
+	} else {
+		err = trans.RecvFile(tmp)
+	}
+	if err != nil {
+		return err
+	}
+	if f, err = os.Open(tmp); err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// flagSet tells if the flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// confirmOnStdin asks on the terminal whether to accept a peer missing from
+// the address book.
+func confirmOnStdin(peerId string) bool {
+	fmt.Fprintf(os.Stderr, "accept unknown peer %s? [y/N] ", peerId)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"p2faster/peer"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+func (a *App) contactsUI() fyne.CanvasObject {
+	a.contactSelect = widget.NewSelect(nil, func(name string) {
+		if c, ok := a.contacts[name]; ok {
+			a.peerIdEntry.SetText(c.Target())
+		}
+	})
+	a.contactSelect.PlaceHolder = "pick a contact"
+	a.refreshContacts()
+
+	saveButton := widget.NewButton("save contact", a.onSaveContact)
+	return container.NewGridWithColumns(2, a.contactSelect, saveButton)
+}
+
+func (a *App) refreshContacts() {
+	a.contacts = make(map[string]peer.Contact)
+	var names []string
+	for _, c := range a.conn.AddressBook().Contacts() {
+		name := fmt.Sprintf("%s (%s)", c.Nickname, shortId(c.ID))
+		a.contacts[name] = c
+		names = append(names, name)
+	}
+	a.contactSelect.Options = names
+	a.contactSelect.Refresh()
+}
+
+func (a *App) onSaveContact() {
+	target := a.peerIdEntry.Text
+	id := a.conn.PeerId()
+	if len(id) == 0 {
+		var err error
+		id, err = peer.TargetPeerId(target)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("invalid peer id or address"), a.window)
+			return
+		}
+	}
+
+	contact, _ := a.conn.AddressBook().Get(id)
+	contact.ID = id
+	if target != id && len(target) > 0 {
+		contact.Address = target
+	}
+
+	nickname := widget.NewEntry()
+	nickname.SetText(contact.Nickname)
+	trust := widget.NewSelect([]string{string(peer.TrustTrusted), string(peer.TrustConfirm), string(peer.TrustBlocked)}, nil)
+	trust.SetSelected(string(peer.TrustConfirm))
+	if len(contact.Trust) > 0 {
+		trust.SetSelected(string(contact.Trust))
+	}
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("nickname", nickname),
+		widget.NewFormItem("trust", trust),
+	}
+	dialog.ShowForm("save contact", "save", "cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		contact.Nickname = nickname.Text
+		contact.Trust = peer.TrustLevel(trust.Selected)
+		if err := a.conn.AddressBook().Put(contact); err != nil {
+			log.Errorf("save contact failed. err:%v", err)
+			dialog.ShowError(err, a.window)
+			return
+		}
+		a.refreshContacts()
+	}, a.window)
+}
+
+// onConfirmPeer asks the user whether to accept a session from a peer that
+// needs confirmation.
+func (a *App) onConfirmPeer(peerId string) bool {
+	if a.window == nil {
+		return false
+	}
+
+	name := peerId
+	if c, ok := a.conn.AddressBook().Get(peerId); ok && len(c.Nickname) > 0 {
+		name = fmt.Sprintf("%s (%s)", c.Nickname, shortId(peerId))
+	}
+
+	accept := make(chan bool)
+	dialog.ShowConfirm("incoming connection", fmt.Sprintf("accept a session from %s?", name), func(ok bool) {
+		accept <- ok
+	}, a.window)
+	return <-accept
+}
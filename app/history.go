@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"p2faster/peer"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// transferLog follows a transfer until its outcome is known, then saves it
+// in the history once.
+type transferLog struct {
+	conn  *peer.BinaryConn
+	rec   *peer.TransferRecord
+	trans *peer.Transmission
+	once  sync.Once
+}
+
+// startLog starts the record of a transfer of the offer with the peer of
+// the session, path is the local file.
+func startLog(conn *peer.BinaryConn, direction, path string, offer *SendFile) *transferLog {
+	peerId := conn.PeerId()
+	rec := &peer.TransferRecord{
+		Direction: direction,
+		PeerId:    peerId,
+		Name:      offer.FileName,
+		Dir:       offer.Dir,
+		Path:      path,
+		Size:      int64(offer.Size),
+		Start:     time.Now(),
+	}
+	// a stream has no local file
+	if abs, err := filepath.Abs(path); err == nil && path != "" {
+		rec.Path = abs
+	}
+	if contact, ok := conn.AddressBook().Get(peerId); ok {
+		rec.Nickname = contact.Nickname
+	}
+	return &transferLog{conn: conn, rec: rec}
+}
+
+// begin times the transfer from now on.
+func (l *transferLog) begin(trans *peer.Transmission) {
+	l.trans = trans
+	l.rec.Start = time.Now()
+}
+
+func (l *transferLog) finish(code int, msg string) {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		l.rec.Duration = time.Since(l.rec.Start)
+		if l.rec.Size == 0 && l.trans != nil {
+			l.rec.Size = l.trans.StreamSize()
+		}
+		if l.trans != nil {
+			l.rec.Hash = l.trans.Hash()
+			l.rec.Relayed = l.trans.Relayed()
+		}
+		if code != CODE_OK {
+			l.rec.Error = codeReason(code, msg)
+		}
+		if err := l.conn.History().Add(l.rec); err != nil {
+			log.Errorf("save transfer history failed. err:%v", err)
+		}
+	})
+}
+
+func formatRecord(r *peer.TransferRecord) string {
+	name := r.Nickname
+	if name == "" {
+		name = shortId(r.PeerId)
+	}
+	direction := "to"
+	if r.Direction == peer.TransferReceive {
+		direction = "from"
+	}
+	route := "direct"
+	if r.Relayed {
+		route = "relayed"
+	}
+	outcome := "ok"
+	if r.Error != "" {
+		outcome = "failed, " + r.Error
+	}
+	hash := r.Hash
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return fmt.Sprintf("#%d %s %s %s %s %s, %d bytes in %v (%.1f KiB/s), %s, sha256 %s, %s",
+		r.ID, r.Start.Format("2006-01-02 15:04"), r.Direction, r.Name, direction, name,
+		r.Size, r.Duration.Round(time.Millisecond), r.Speed()/1024, route, hash, outcome)
+}
+
+// openFolder shows the folder holding the file of a transfer in the file
+// manager.
+func openFolder(r *peer.TransferRecord) error {
+	dir := r.Path
+	if !r.Dir {
+		dir = filepath.Dir(r.Path)
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", dir)
+	case "windows":
+		cmd = exec.Command("explorer", dir)
+	default:
+		cmd = exec.Command("xdg-open", dir)
+	}
+	return cmd.Start()
+}
+
+func (a *App) historyUI() fyne.CanvasObject {
+	return widget.NewButton("history", a.onHistoryButton)
+}
+
+func (a *App) onHistoryButton() {
+	records, err := a.conn.History().List(100)
+	if err != nil {
+		log.Errorf("read transfer history failed. err:%v", err)
+		dialog.ShowError(err, a.window)
+		return
+	}
+
+	rows := container.NewVBox()
+	if len(records) == 0 {
+		rows.Add(widget.NewLabel("no transfer yet"))
+	}
+	for i := range records {
+		r := &records[i]
+		open := widget.NewButton("open folder", func() {
+			if err := openFolder(r); err != nil {
+				dialog.ShowError(err, a.window)
+			}
+		})
+		resend := widget.NewButton("resend", func() { a.onResend(r) })
+		if r.Direction != peer.TransferSend {
+			resend.Disable()
+		}
+		rows.Add(container.NewBorder(nil, nil, nil, container.NewHBox(open, resend), widget.NewLabel(formatRecord(r))))
+	}
+	scroll := container.NewVScroll(rows)
+	scroll.SetMinSize(fyne.NewSize(720, 320))
+	dialog.ShowCustom("transfer history", "close", scroll, a.window)
+}
+
+// onResend offers the file of a past send again to the same peer,
+// connecting first when needed.
+func (a *App) onResend(r *peer.TransferRecord) {
+	a.filePathEntry.SetText(r.Path)
+	if a.conn.PeerId() != r.PeerId {
+		a.peerIdEntry.SetText(r.PeerId)
+		a.onConnButton(r.PeerId)
+		if a.conn.PeerId() != r.PeerId {
+			dialog.ShowError(fmt.Errorf("can not resend, no connection to %s", shortId(r.PeerId)), a.window)
+			return
+		}
+	}
+	a.sendButton.OnTapped()
+}
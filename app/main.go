@@ -1,6 +1,11 @@
 package main
 
+import "os"
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCli(os.Args[1:]))
+	}
 	a := &App{}
 	a.Start()
 }
@@ -2,7 +2,13 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"p2faster/peer"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
@@ -12,25 +18,126 @@ type HeartBeat struct {
 	Msg string `json:"msg"`
 }
 
+// TRANSFER_VERSION is the format of send streams, a peer refuses offers of
+// another version with CODE_UNSUPPORTED_VERSION.
+const TRANSFER_VERSION = 3
+
 type SendFile struct {
-	FileName string `json:"file_name"`
-	Size     int    `json:"file_size"`
+	FileName string         `json:"file_name"`
+	Size     int            `json:"file_size"`
+	Meta     *peer.FileMeta `json:"meta,omitempty"`
+	// Dir offers a directory, sent as a peer.DirManifest and its content
+	Dir bool `json:"dir,omitempty"`
+	// Delta asks the receiver for the signature of its copy, see
+	// peer.Transmission.SendFileDelta
+	Delta bool `json:"delta,omitempty"`
+	// Stream offers data of unknown length, Size is 0, see
+	// peer.Transmission.SendStream
+	Stream  bool `json:"stream,omitempty"`
+	Version int  `json:"version"`
+}
+
+// TransferDone is sent by the receiver once a transfer ends, with the code
+// of its outcome.
+type TransferDone struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+// Verify carries the nonce each side picks for the session, both nonces feed
+// the short authentication string. The client first sends only the
+// commitment to its nonce, and reveals the nonce once it got the server's,
+// so neither side can pick its nonce knowing the other one.
+type Verify struct {
+	Commit []byte `json:"commit,omitempty"`
+	Nonce  []byte `json:"nonce,omitempty"`
 }
 
 const (
 	HEART_BEAT = 1
 	SEND_FILE  = 2
+	VERIFY     = 3
+	BYE        = 4 // the peer is leaving, no response
+	DONE       = 5 // a transfer ended, no response
+	REVEAL     = 6 // the client nonce after the VERIFY response, no response
 )
 
 type Request struct {
-	MsgType   int        `json:"msg_type"`
-	HeartBeat *HeartBeat `json:"heart_beat"`
-	SendFile  *SendFile  `json:"send_file"`
+	MsgType   int           `json:"msg_type"`
+	HeartBeat *HeartBeat    `json:"heart_beat"`
+	SendFile  *SendFile     `json:"send_file"`
+	Verify    *Verify       `json:"verify"`
+	Done      *TransferDone `json:"done,omitempty"`
 }
 
+// Response tells the outcome of a request, Msg details an error code.
 type Response struct {
-	MsgType int `json:"msg_type"`
-	Code    int `json:"code"`
+	MsgType int     `json:"msg_type"`
+	Code    int     `json:"code"`
+	Msg     string  `json:"msg,omitempty"`
+	Verify  *Verify `json:"verify"`
+}
+
+// Codes of a send file response and of a finished transfer.
+const (
+	CODE_OK                  = 0
+	CODE_DECLINED            = -1 // the user refused the file
+	CODE_NO_SPACE            = 1  // not enough free space at the destination
+	CODE_TOO_LARGE           = 2  // over the size the receiver accepts
+	CODE_PATH_REJECTED       = 3  // the destination or a path in a directory is refused
+	CODE_BUSY                = 4  // the receiver is already receiving
+	CODE_UNSUPPORTED_VERSION = 5  // the offer uses another TRANSFER_VERSION
+	CODE_HASH_MISMATCH       = 6  // the received content differs from the sent one
+	CODE_INTERNAL            = 7  // any other failure, see the message
+)
+
+// codeReason describes a code for the user, with the message detailing it.
+func codeReason(code int, msg string) string {
+	var reason string
+	switch code {
+	case CODE_OK:
+		reason = "done"
+	case CODE_DECLINED:
+		reason = "declined by the user"
+	case CODE_NO_SPACE:
+		reason = "not enough free space"
+	case CODE_TOO_LARGE:
+		reason = "larger than the receiver accepts"
+	case CODE_PATH_REJECTED:
+		reason = "destination path rejected"
+	case CODE_BUSY:
+		reason = "receiver busy with another transfer"
+	case CODE_UNSUPPORTED_VERSION:
+		reason = "unsupported transfer version"
+	case CODE_HASH_MISMATCH:
+		reason = "received content does not match"
+	case CODE_INTERNAL:
+		reason = "internal error"
+	default:
+		reason = fmt.Sprintf("unknown error %d", code)
+	}
+	if msg != "" {
+		return reason + ": " + msg
+	}
+	return reason
+}
+
+// errorCode maps the error of a check or a transfer to its code and message.
+func errorCode(err error) (int, string) {
+	switch {
+	case err == nil:
+		return CODE_OK, ""
+	case errors.Is(err, peer.ErrTooLarge):
+		return CODE_TOO_LARGE, err.Error()
+	case errors.Is(err, peer.ErrNoSpace):
+		return CODE_NO_SPACE, err.Error()
+	case errors.Is(err, peer.ErrPathRejected):
+		return CODE_PATH_REJECTED, err.Error()
+	case errors.Is(err, peer.ErrHashMismatch):
+		return CODE_HASH_MISMATCH, err.Error()
+	default:
+		return CODE_INTERNAL, err.Error()
+	}
 }
 
 const (
@@ -54,45 +161,108 @@ type MsgDispatch struct {
 	stream       network.Stream
 	heartTime    int64
 	side         int
-	onServerFile func(name string, size int) bool
-	onClientFile func(send bool)
+	onServerFile func(file *SendFile) (int, string)
+	onClientFile func(code int, msg string)
+	onDone       func(code int, msg string)
+	nonce        []byte
+	remoteCommit []byte
+	revealed     bool
+	onVerify     func(localNonce, remoteNonce []byte)
+	onClose      func()
+	done         chan struct{}
+	writeLock    sync.Mutex
 }
 
-func CreateMsgDispatch(stream network.Stream, side int, onServerFile func(name string, size int) bool, onClientFile func(send bool)) *MsgDispatch {
+func CreateMsgDispatch(stream network.Stream, side int, onServerFile func(file *SendFile) (int, string), onClientFile func(code int, msg string)) *MsgDispatch {
 	return &MsgDispatch{
 		rw:           bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream)),
 		stream:       stream,
 		side:         side,
 		onServerFile: onServerFile,
 		onClientFile: onClientFile,
+		nonce:        createNonce(),
+		done:         make(chan struct{}),
 	}
 }
 
-func CreateMsgDispatchWithBufio(rw *bufio.ReadWriter, side int, onServerFile func(name string, size int) bool, onClientFile func(send bool)) *MsgDispatch {
+func CreateMsgDispatchWithBufio(rw *bufio.ReadWriter, side int, onServerFile func(file *SendFile) (int, string), onClientFile func(code int, msg string)) *MsgDispatch {
 	return &MsgDispatch{
 		rw:           rw,
 		side:         side,
 		onServerFile: onServerFile,
 		onClientFile: onClientFile,
+		nonce:        createNonce(),
+		done:         make(chan struct{}),
 	}
 }
 
+// SetVerifyHandler sets the callback invoked with both session nonces once
+// they are exchanged. It must be called before Start.
+func (m *MsgDispatch) SetVerifyHandler(onVerify func(localNonce, remoteNonce []byte)) {
+	m.onVerify = onVerify
+}
+
+// SetDoneHandler sets the callback invoked with the outcome the receiver
+// reports at the end of a transfer. It must be called before Start.
+func (m *MsgDispatch) SetDoneHandler(onDone func(code int, msg string)) {
+	m.onDone = onDone
+}
+
+// SetCloseHandler sets the callback invoked once when the peer says bye or
+// the session breaks. It must be called before Start.
+func (m *MsgDispatch) SetCloseHandler(onClose func()) {
+	m.onClose = onClose
+}
+
 func (m *MsgDispatch) Start() {
 	go m.read()
 	if m.side == CLIENT {
 		go m.ClientHeartTimer()
+
+		msg := &Msg{
+			MsgType: REQUEST,
+			Request: &Request{
+				MsgType: VERIFY,
+				Verify: &Verify{
+					Commit: peer.NonceCommitment(m.nonce),
+				},
+			},
+		}
+		m.writeMsg(msg)
 	}
 }
 
-func (m *MsgDispatch) ConferSendFile(name string, size int) {
+// ConferSendFile offers a file, the peer answers with the code given to the
+// client file callback.
+func (m *MsgDispatch) ConferSendFile(file *SendFile) {
+	file.Version = TRANSFER_VERSION
 	msg := &Msg{
 		MsgType: REQUEST,
 		Request: &Request{
-			MsgType: SEND_FILE,
-			SendFile: &SendFile{
-				FileName: name,
-				Size:     size,
-			},
+			MsgType:  SEND_FILE,
+			SendFile: file,
+		},
+	}
+	m.writeMsg(msg)
+}
+
+// Done tells the sender how the transfer ended.
+func (m *MsgDispatch) Done(code int, msg string) {
+	m.writeMsg(&Msg{
+		MsgType: REQUEST,
+		Request: &Request{
+			MsgType: DONE,
+			Done:    &TransferDone{Code: code, Msg: msg},
+		},
+	})
+}
+
+// Bye tells the peer we are leaving.
+func (m *MsgDispatch) Bye() {
+	msg := &Msg{
+		MsgType: REQUEST,
+		Request: &Request{
+			MsgType: BYE,
 		},
 	}
 	m.writeMsg(msg)
@@ -100,8 +270,13 @@ func (m *MsgDispatch) ConferSendFile(name string, size int) {
 
 func (m *MsgDispatch) ClientHeartTimer() {
 	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
 
 		msg := &Msg{
 			MsgType: REQUEST,
@@ -119,18 +294,18 @@ func (m *MsgDispatch) ClientHeartTimer() {
 }
 
 func (m *MsgDispatch) read() {
-	for {
-		data := make([]byte, 1024)
-		count, err := m.rw.Read(data)
-
-		if err != nil {
-			log.Errorf("read data from peer failed. err:%v", err)
-			return
+	defer func() {
+		close(m.done)
+		if m.onClose != nil {
+			m.onClose()
 		}
-
+	}()
+	// messages are json values back to back, the decoder splits them
+	// whatever their size
+	decoder := json.NewDecoder(m.rw)
+	for {
 		msg := Msg{}
-		err = json.Unmarshal(data[:count], &msg)
-		if err != nil {
+		if err := decoder.Decode(&msg); err != nil {
 			log.Errorf("read data from peer failed. err:%v", err)
 			return
 		}
@@ -143,6 +318,15 @@ func (m *MsgDispatch) read() {
 				m.onServerHeart(req)
 			case SEND_FILE:
 				m.onServerSendFile(req)
+			case VERIFY:
+				m.onServerVerify(req)
+			case REVEAL:
+				m.onServerReveal(req)
+			case DONE:
+				m.onServerDone(req)
+			case BYE:
+				log.Infof("peer said bye.")
+				return
 			}
 
 		} else {
@@ -152,6 +336,8 @@ func (m *MsgDispatch) read() {
 				m.onClientHeart(resp)
 			case SEND_FILE:
 				m.onClientSendFile(resp)
+			case VERIFY:
+				m.onClientVerify(resp)
 			}
 		}
 	}
@@ -163,12 +349,27 @@ func (m *MsgDispatch) onClientHeart(resp *Response) {
 }
 
 func (m *MsgDispatch) onClientSendFile(resp *Response) {
-	if resp.Code == 0 {
-		m.onClientFile(true)
-	} else {
-		m.onClientFile(false)
+	m.onClientFile(resp.Code, resp.Msg)
+	log.Infof("get a send file response. code:%v, msg:%s", resp.Code, resp.Msg)
+}
+
+// onClientVerify reveals our nonce now that the server picked its own.
+func (m *MsgDispatch) onClientVerify(resp *Response) {
+	log.Debugf("get a verify response.")
+	if resp.Verify == nil || len(resp.Verify.Nonce) == 0 || m.revealed {
+		return
+	}
+	m.revealed = true
+	m.writeMsg(&Msg{
+		MsgType: REQUEST,
+		Request: &Request{
+			MsgType: REVEAL,
+			Verify:  &Verify{Nonce: m.nonce},
+		},
+	})
+	if m.onVerify != nil {
+		m.onVerify(m.nonce, resp.Verify.Nonce)
 	}
-	log.Infof("get a send file response. code:%v", resp.Code)
 }
 
 func (m *MsgDispatch) onServerHeart(*Request) {
@@ -185,22 +386,72 @@ func (m *MsgDispatch) onServerHeart(*Request) {
 }
 
 func (m *MsgDispatch) onServerSendFile(req *Request) {
-	recv := m.onServerFile(req.SendFile.FileName, req.SendFile.Size)
+	file := req.SendFile
+	code, reason := CODE_UNSUPPORTED_VERSION, fmt.Sprintf("version %d, want %d", file.Version, TRANSFER_VERSION)
+	if file.Version == TRANSFER_VERSION {
+		code, reason = m.onServerFile(file)
+	}
 	msg := &Msg{
 		MsgType: RESPONSE,
 		Response: &Response{
 			MsgType: SEND_FILE,
+			Code:    code,
+			Msg:     reason,
 		},
 	}
-	if recv {
-		msg.Response.Code = 0
-	} else {
-		msg.Response.Code = -1
+	m.writeMsg(msg)
+
+	log.Infof("get a file request. name:%s, code:%v, msg:%s", file.FileName, code, reason)
+}
+
+func (m *MsgDispatch) onServerDone(req *Request) {
+	if req.Done == nil {
+		return
+	}
+	log.Infof("get a transfer result. code:%v, msg:%s", req.Done.Code, req.Done.Msg)
+	if m.onDone != nil {
+		m.onDone(req.Done.Code, req.Done.Msg)
+	}
+}
+
+func (m *MsgDispatch) onServerVerify(req *Request) {
+	log.Debugf("get a verify request.")
+	if req.Verify == nil || len(req.Verify.Commit) == 0 || m.remoteCommit != nil {
+		log.Infof("refuse verify request without a nonce commitment.")
+		return
+	}
+	m.remoteCommit = req.Verify.Commit
+
+	msg := &Msg{
+		MsgType: RESPONSE,
+		Response: &Response{
+			MsgType: VERIFY,
+			Code:    0,
+			Verify: &Verify{
+				Nonce: m.nonce,
+			},
+		},
 	}
 	m.writeMsg(msg)
+}
 
-	log.Infof("get a file request. name:%s, result:%v", req.SendFile.FileName, recv)
+// onServerReveal checks the client nonce against the commitment it sent
+// before it knew ours.
+func (m *MsgDispatch) onServerReveal(req *Request) {
+	log.Debugf("get a nonce reveal.")
+	if req.Verify == nil || m.remoteCommit == nil || m.revealed {
+		return
+	}
+	m.revealed = true
+	if !bytes.Equal(peer.NonceCommitment(req.Verify.Nonce), m.remoteCommit) {
+		log.Errorf("peer nonce does not match its commitment, the session may be intercepted.")
+		return
+	}
+	if m.onVerify != nil {
+		m.onVerify(m.nonce, req.Verify.Nonce)
+	}
 }
+
 func (m *MsgDispatch) writeMsg(msg *Msg) error {
 	sendBuf, err := json.Marshal(msg)
 	if err != nil {
@@ -211,6 +462,8 @@ func (m *MsgDispatch) writeMsg(msg *Msg) error {
 }
 
 func (m *MsgDispatch) write(data []byte) error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
 	writeCount := 0
 	for {
 		count, err := m.rw.Write(data[writeCount:])
@@ -226,3 +479,11 @@ func (m *MsgDispatch) write(data []byte) error {
 	}
 	return nil
 }
+
+func createNonce() []byte {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Errorf("create nonce failed. err:%v", err)
+	}
+	return nonce
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"p2faster/peer"
 	"testing"
 	"time"
 
@@ -34,12 +37,12 @@ func TestMsgDispatch(t *testing.T) {
 	serverDispatcher := CreateMsgDispatchWithBufio(
 		rw,
 		SERVER,
-		func(name string, size int) bool {
-			log.Infof("server get a send file request. name:%v, size:%v", name, size)
-			return true
+		func(file *SendFile) (int, string) {
+			log.Infof("server get a send file request. name:%v, size:%v", file.FileName, file.Size)
+			return CODE_OK, ""
 		},
-		func(recv bool) {
-			log.Infof("server get a send file respnse. recv:%v", recv)
+		func(code int, msg string) {
+			log.Infof("server get a send file respnse. code:%v, msg:%s", code, msg)
 		},
 	)
 	serverDispatcher.Start()
@@ -47,18 +50,43 @@ func TestMsgDispatch(t *testing.T) {
 	clientDispatcher := CreateMsgDispatchWithBufio(
 		rw,
 		CLIENT,
-		func(name string, size int) bool {
-			log.Infof("client get a send file request. name:%v, size:%v", name, size)
-			return true
+		func(file *SendFile) (int, string) {
+			log.Infof("client get a send file request. name:%v, size:%v", file.FileName, file.Size)
+			return CODE_OK, ""
 		},
-		func(recv bool) {
-			log.Infof("client get a send file respnse. recv:%v", recv)
+		func(code int, msg string) {
+			log.Infof("client get a send file respnse. code:%v, msg:%s", code, msg)
 		},
 	)
 	clientDispatcher.Start()
 
-	clientDispatcher.ConferSendFile("client file name", 10234)
-	serverDispatcher.ConferSendFile("server file name", 10234)
+	clientDispatcher.ConferSendFile(&SendFile{FileName: "client file name", Size: 10234})
+	serverDispatcher.ConferSendFile(&SendFile{FileName: "server file name", Size: 10234, Delta: true, Meta: &peer.FileMeta{Mode: 0755}})
 
 	time.Sleep(60 * time.Second)
 }
+
+func TestErrorCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, CODE_OK},
+		{fmt.Errorf("%w: disk", peer.ErrNoSpace), CODE_NO_SPACE},
+		{fmt.Errorf("%w: big", peer.ErrTooLarge), CODE_TOO_LARGE},
+		{fmt.Errorf("%w: link", peer.ErrPathRejected), CODE_PATH_REJECTED},
+		{peer.ErrHashMismatch, CODE_HASH_MISMATCH},
+		{errors.New("broken pipe"), CODE_INTERNAL},
+	} {
+		code, msg := errorCode(c.err)
+		if code != c.code {
+			t.Errorf("unexpected code %d for %v", code, c.err)
+		}
+		if c.err != nil && msg != c.err.Error() {
+			t.Errorf("unexpected message %q for %v", msg, c.err)
+		}
+	}
+	if reason := codeReason(CODE_BUSY, ""); reason != "receiver busy with another transfer" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+}
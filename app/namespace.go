@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// namespaceUI registers in a namespace at the relay and picks one of its
+// online members as the peer to connect.
+func (a *App) namespaceUI() fyne.CanvasObject {
+	a.namespaceEntry = widget.NewEntry()
+	a.namespaceEntry.SetPlaceHolder("namespace, e.g. team-infra")
+	a.memberSelect = widget.NewSelect(nil, func(id string) {
+		if target, ok := a.members[id]; ok {
+			a.peerIdEntry.SetText(target)
+		}
+	})
+	a.memberSelect.PlaceHolder = "online members"
+
+	joinButton := widget.NewButton("join", a.onJoinNamespace)
+	return container.NewGridWithColumns(3, a.namespaceEntry, joinButton, a.memberSelect)
+}
+
+func (a *App) onJoinNamespace() {
+	namespace := a.namespaceEntry.Text
+	go func() {
+		if err := a.conn.Register(namespace); err != nil {
+			log.Errorf("register in namespace failed. namespace:%s, err:%v", namespace, err)
+			dialog.ShowError(err, a.window)
+			return
+		}
+		peers, err := a.conn.NamespacePeers(namespace)
+		if err != nil {
+			log.Errorf("list namespace members failed. namespace:%s, err:%v", namespace, err)
+			dialog.ShowError(err, a.window)
+			return
+		}
+
+		a.members = make(map[string]string)
+		var names []string
+		for _, p := range peers {
+			name := shortId(p.ID)
+			a.members[name] = p.Target()
+			names = append(names, name)
+		}
+		a.memberSelect.Options = names
+		a.memberSelect.Refresh()
+	}()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"p2faster/peer"
+	"path/filepath"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+func (a *App) offlineUI() fyne.CanvasObject {
+	return widget.NewButton("send offline", a.onOfflineButton)
+}
+
+// onOfflineButton leaves the file at the relay for a peer that is not
+// online, it is delivered when the peer next connects.
+func (a *App) onOfflineButton() {
+	peerId, path := a.peerIdEntry.Text, a.filePathEntry.Text
+	log.Infof("send file offline. peer:%s, path:%s", peerId, path)
+	go func() {
+		if err := a.conn.SendOffline(peerId, path); err != nil {
+			log.Errorf("send file offline failed. err:%v", err)
+			dialog.ShowError(err, a.window)
+			return
+		}
+		dialog.ShowInformation("send offline", "the file waits at the relay until the peer connects.", a.window)
+	}()
+}
+
+// onOfflineFile saves files received through the relay in the inbox.
+func (a *App) onOfflineFile(peerId string, file *peer.OfflineFile) string {
+	dir := filepath.Join(peer.ConfigDir(), "inbox")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Errorf("create inbox failed. err:%v", err)
+		return ""
+	}
+	path := filepath.Join(dir, file.Name)
+	if _, err := os.Stat(path); err == nil {
+		path = filepath.Join(dir, fmt.Sprintf("%d-%s", time.Now().Unix(), file.Name))
+	}
+
+	if a.app != nil {
+		a.app.SendNotification(fyne.NewNotification("p2faster",
+			fmt.Sprintf("%s left %s for you, saving it in %s", shortId(peerId), file.Name, dir)))
+	}
+	return path
+}
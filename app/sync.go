@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"p2faster/peer"
+	"path/filepath"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+func (a *App) syncUI() fyne.CanvasObject {
+	return widget.NewButton("sync folder", a.onSyncButton)
+}
+
+// onSyncButton keeps the folder in the file path in sync with the
+// connected peer, the peer must add a folder with the same ID.
+func (a *App) onSyncButton() {
+	peerId := a.conn.PeerId()
+	if peerId == "" {
+		peerId = a.peerIdEntry.Text
+	}
+	path := widget.NewEntry()
+	path.SetText(a.filePathEntry.Text)
+	id := widget.NewEntry()
+	id.SetText(filepath.Base(a.filePathEntry.Text))
+	mode := widget.NewSelect([]string{string(peer.SyncBoth), string(peer.SyncSend), string(peer.SyncReceive)}, nil)
+	mode.SetSelected(string(peer.SyncBoth))
+
+	synced := widget.NewLabel("")
+	for _, f := range a.conn.FolderSync().Folders() {
+		synced.SetText(synced.Text + fmt.Sprintf("%s: %s with %s (%s)\n", f.ID, f.Path, shortId(f.Peer), f.Mode))
+	}
+	items := []*widget.FormItem{
+		widget.NewFormItem("folder", path),
+		widget.NewFormItem("folder ID", id),
+		widget.NewFormItem("mode", mode),
+		widget.NewFormItem("synced", synced),
+	}
+	dialog.ShowForm("sync a folder with "+shortId(peerId), "sync", "cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		folder := peer.SyncFolder{ID: id.Text, Path: path.Text, Peer: peerId, Mode: peer.SyncMode(mode.Selected)}
+		if err := a.conn.FolderSync().Add(folder); err != nil {
+			log.Errorf("add sync folder failed. err:%v", err)
+			dialog.ShowError(err, a.window)
+		}
+	}, a.window)
+}
+
+// onSyncEvent tells about conflicts and failures, the copies of a conflict
+// are both kept.
+func (a *App) onSyncEvent(e peer.SyncEvent) {
+	if a.app == nil {
+		return
+	}
+	switch e.Type {
+	case peer.SyncConflict:
+		a.app.SendNotification(fyne.NewNotification("p2faster",
+			fmt.Sprintf("sync conflict in %s, the other version is kept as %s", e.Folder, e.Path)))
+	case peer.SyncFailed:
+		a.app.SendNotification(fyne.NewNotification("p2faster",
+			fmt.Sprintf("sync %s failed for %s: %v", e.Folder, e.Path, e.Err)))
+	}
+}
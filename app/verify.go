@@ -0,0 +1,51 @@
+package main
+
+import (
+	"p2faster/peer"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+func (a *App) verifyUI() fyne.CanvasObject {
+	sasTip := widget.NewLabel("safety words:")
+	a.sasLabel = widget.NewLabel("-")
+	a.verifyButton = widget.NewButton("mark verified", a.onVerifyButton)
+	a.verifyButton.Disable()
+	return container.NewGridWithColumns(3, sasTip, a.sasLabel, a.verifyButton)
+}
+
+// onVerify shows the short authentication string of the session once both
+// nonces are known, the user compares it with the peer out of band.
+func (a *App) onVerify(localNonce, remoteNonce []byte) {
+	peerId := a.conn.PeerId()
+	sas := peer.ShortAuthString(a.localId, peerId, localNonce, remoteNonce)
+	log.Infof("session safety words. peer:%s, words:%s", peerId, sas)
+
+	a.sasLabel.SetText(sas)
+	if c, ok := a.conn.AddressBook().Get(peerId); ok && c.Verified {
+		a.verifyButton.SetText("verified")
+		a.verifyButton.Disable()
+		return
+	}
+	a.verifyButton.SetText("mark verified")
+	a.verifyButton.Enable()
+}
+
+func (a *App) onVerifyButton() {
+	dialog.ShowConfirm("verify peer", "do the safety words match the ones shown on the peer?", func(ok bool) {
+		if !ok {
+			return
+		}
+		if err := a.conn.AddressBook().MarkVerified(a.conn.PeerId()); err != nil {
+			log.Errorf("save verified peer failed. err:%v", err)
+			dialog.ShowError(err, a.window)
+			return
+		}
+		a.verifyButton.SetText("verified")
+		a.verifyButton.Disable()
+		a.refreshContacts()
+	}, a.window)
+}
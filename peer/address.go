@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// parseTarget turns what the user typed into the peer to dial. A plain peer
+// ID has no addresses and is looked up, a multiaddr or <peer id>@<host>:<port>
+// carries the addresses to dial directly.
+func parseTarget(target string) (peer.AddrInfo, error) {
+	target = strings.TrimSpace(target)
+
+	if strings.HasPrefix(target, "/") {
+		addr, err := ma.NewMultiaddr(target)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		return *info, nil
+	}
+
+	if idPart, hostPort, ok := strings.Cut(target, "@"); ok {
+		id, err := peer.Decode(idPart)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		addrs, err := hostPortAddrs(hostPort)
+		if err != nil {
+			return peer.AddrInfo{}, err
+		}
+		return peer.AddrInfo{ID: id, Addrs: addrs}, nil
+	}
+
+	id, err := peer.Decode(target)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	return peer.AddrInfo{ID: id}, nil
+}
+
+// TargetPeerId returns the peer ID of anything BinaryConn.Connect accepts.
+func TargetPeerId(target string) (string, error) {
+	info, err := parseTarget(target)
+	if err != nil {
+		return "", err
+	}
+	return info.ID.String(), nil
+}
+
+// hostPortAddrs builds the tcp and quic multiaddrs for host:port.
+func hostPortAddrs(hostPort string) ([]ma.Multiaddr, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := "dns"
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			proto = "ip4"
+		} else {
+			proto = "ip6"
+		}
+	}
+
+	var addrs []ma.Multiaddr
+	for _, transport := range []string{"tcp/%s", "udp/%s/quic-v1"} {
+		addr, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s/"+transport, proto, host, port))
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
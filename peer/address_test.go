@@ -0,0 +1,56 @@
+package peer
+
+import (
+	"testing"
+)
+
+const testPeerId = "12D3KooW9qaj35NgxHjtrH6uKEKKgE1iPhYjrKpTKnDh1mUeGCAh"
+
+func TestParseTarget(t *testing.T) {
+	cases := []struct {
+		target string
+		addrs  []string
+	}{
+		{testPeerId, nil},
+		{"/ip4/10.0.0.5/udp/4001/quic-v1/p2p/" + testPeerId, []string{"/ip4/10.0.0.5/udp/4001/quic-v1"}},
+		{testPeerId + "@10.0.0.5:4001", []string{"/ip4/10.0.0.5/tcp/4001", "/ip4/10.0.0.5/udp/4001/quic-v1"}},
+		{testPeerId + "@[fe80::1]:4001", []string{"/ip6/fe80::1/tcp/4001", "/ip6/fe80::1/udp/4001/quic-v1"}},
+		{testPeerId + "@build.local:4001", []string{"/dns/build.local/tcp/4001", "/dns/build.local/udp/4001/quic-v1"}},
+	}
+
+	for _, c := range cases {
+		info, err := parseTarget(c.target)
+		if err != nil {
+			t.Fatalf("parse %s failed. err:%v", c.target, err)
+		}
+		if info.ID.String() != testPeerId {
+			t.Errorf("parse %s got peer %s", c.target, info.ID)
+		}
+		if len(info.Addrs) != len(c.addrs) {
+			t.Fatalf("parse %s got addrs %v", c.target, info.Addrs)
+		}
+		for i, addr := range info.Addrs {
+			if addr.String() != c.addrs[i] {
+				t.Errorf("parse %s got addr %s, want %s", c.target, addr, c.addrs[i])
+			}
+		}
+	}
+
+	for _, target := range []string{"", "not-a-peer", testPeerId + "@10.0.0.5", "/ip4/10.0.0.5/tcp/4001"} {
+		if _, err := parseTarget(target); err == nil {
+			t.Errorf("parse %q should fail", target)
+		}
+	}
+}
+
+func TestConnectRelayInvalidAddress(t *testing.T) {
+	// the address is refused before the host is used
+	for _, addr := range []string{"/ip4/10.0.0.5/tpc/4001", "10.0.0.5:4001"} {
+		if _, err := connectRelay(nil, testPeerId, addr); err == nil {
+			t.Errorf("relay address %s accepted", addr)
+		}
+	}
+	if _, err := connectRelay(nil, "not-a-peer", "/ip4/10.0.0.5/tcp/4001"); err == nil {
+		t.Errorf("relay id accepted")
+	}
+}
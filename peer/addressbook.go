@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// TrustLevel decides whether a peer may connect to us.
+type TrustLevel string
+
+const (
+	// TrustBlocked peers are refused at the connection level.
+	TrustBlocked TrustLevel = "blocked"
+	// TrustConfirm peers may connect but every chat session must be
+	// confirmed by the user.
+	TrustConfirm TrustLevel = "confirm"
+	// TrustTrusted peers are accepted without asking.
+	TrustTrusted TrustLevel = "trusted"
+)
+
+// Contact is a known peer saved in the address book.
+type Contact struct {
+	ID       string     `json:"id"`
+	Nickname string     `json:"nickname"`
+	Trust    TrustLevel `json:"trust"`
+	// Address is dialed instead of looking the peer up when it is set, it
+	// takes any form BinaryConn.Connect accepts.
+	Address string `json:"address,omitempty"`
+	// Verified is set once the user compared the short authentication
+	// string with the peer.
+	Verified bool `json:"verified"`
+}
+
+// Target returns what to pass to BinaryConn.Connect to reach the contact.
+func (c *Contact) Target() string {
+	if len(c.Address) > 0 {
+		return c.Address
+	}
+	return c.ID
+}
+
+// AddressBook is the persistent list of known peers, stored as json.
+type AddressBook struct {
+	path     string
+	lock     sync.RWMutex
+	contacts map[string]*Contact
+}
+
+// LoadAddressBook reads the address book at path, a missing file is an
+// empty book.
+func LoadAddressBook(path string) (*AddressBook, error) {
+	b := &AddressBook{
+		path:     path,
+		contacts: make(map[string]*Contact),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var contacts []*Contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, err
+	}
+	for _, c := range contacts {
+		b.contacts[c.ID] = c
+	}
+	return b, nil
+}
+
+func (b *AddressBook) Get(id string) (Contact, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	c, ok := b.contacts[id]
+	if !ok {
+		return Contact{}, false
+	}
+	return *c, true
+}
+
+// Contacts returns every contact sorted by nickname.
+func (b *AddressBook) Contacts() []Contact {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.sorted()
+}
+
+func (b *AddressBook) sorted() []Contact {
+	contacts := make([]Contact, 0, len(b.contacts))
+	for _, c := range b.contacts {
+		contacts = append(contacts, *c)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Nickname < contacts[j].Nickname
+	})
+	return contacts
+}
+
+// Put adds or replaces a contact and saves the book.
+func (b *AddressBook) Put(c Contact) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.contacts[c.ID] = &c
+	return b.save()
+}
+
+// MarkVerified records that the user verified the peer, adding it to the
+// book when it is not there yet.
+func (b *AddressBook) MarkVerified(id string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c, ok := b.contacts[id]
+	if !ok {
+		c = &Contact{ID: id, Trust: TrustConfirm}
+		b.contacts[id] = c
+	}
+	c.Verified = true
+	return b.save()
+}
+
+// Remove deletes a contact and saves the book.
+func (b *AddressBook) Remove(id string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.contacts, id)
+	return b.save()
+}
+
+// save writes the book, the lock must be held so concurrent saves never
+// share the temporary file nor write an older snapshot last.
+func (b *AddressBook) save() error {
+	if len(b.path) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0700); err != nil {
+		return err
+	}
+
+	// write aside and rename so a crash never leaves a truncated book
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
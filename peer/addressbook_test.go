@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAddressBook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.json")
+
+	book, err := LoadAddressBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Contacts()) != 0 {
+		t.Fatalf("missing book should be empty")
+	}
+
+	if err := book.Put(Contact{ID: "b", Nickname: "bob", Trust: TrustTrusted}); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Put(Contact{ID: "a", Nickname: "alice", Trust: TrustBlocked, Address: "a@10.0.0.5:4001"}); err != nil {
+		t.Fatal(err)
+	}
+
+	book, err = LoadAddressBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts := book.Contacts()
+	if len(contacts) != 2 || contacts[0].Nickname != "alice" || contacts[1].Nickname != "bob" {
+		t.Fatalf("unexpected contacts %+v", contacts)
+	}
+	if contacts[0].Target() != "a@10.0.0.5:4001" || contacts[1].Target() != "b" {
+		t.Errorf("unexpected targets %s, %s", contacts[0].Target(), contacts[1].Target())
+	}
+
+	if err := book.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := book.Get("a"); ok {
+		t.Errorf("removed contact still present")
+	}
+	if c, ok := book.Get("b"); !ok || c.Trust != TrustTrusted {
+		t.Errorf("unexpected contact %+v", c)
+	}
+}
+
+func TestAddressBookConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	book, err := LoadAddressBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := book.Put(Contact{ID: fmt.Sprint(i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the last save holds every contact
+	saved, err := LoadAddressBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Contacts()) != 20 {
+		t.Errorf("saved %d contacts", len(saved.Contacts()))
+	}
+}
@@ -0,0 +1,256 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// a chunk is found in at most this many places, older ones are forgotten
+const chunkStoreMaxRefs = 4
+
+// ChunkRef is where a chunk lies in a local file.
+type ChunkRef struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// cachedManifest is the manifest of a file as long as it keeps its size and
+// modification time.
+type cachedManifest struct {
+	Path     string         `json:"path"`
+	Size     int64          `json:"size"`
+	ModTime  time.Time      `json:"mod_time"`
+	Manifest *SwarmManifest `json:"manifest"`
+}
+
+// ChunkStore finds the chunks we already hold by their hash, in the files we
+// shared, downloaded or received before, so a swarm download reads them
+// locally instead of asking a peer. Only swarm downloads read from it, a
+// plain receive gets every byte from its sender and a delta receive reuses
+// the file it replaces. It does not copy the data: a chunk is verified
+// every time it is read and dropped once its file changed. It also caches
+// the manifest of shared files by inode so a file is only hashed again when
+// modified.
+type ChunkStore struct {
+	path   string
+	lock   sync.Mutex
+	chunks map[string][]ChunkRef
+	files  map[string]*cachedManifest
+	// dirty tells the store changed since it was loaded or saved
+	dirty bool
+}
+
+type chunkStoreFile struct {
+	Chunks map[string][]ChunkRef      `json:"chunks"`
+	Files  map[string]*cachedManifest `json:"files"`
+}
+
+// LoadChunkStore reads the store saved at path, a missing file is an empty
+// store.
+func LoadChunkStore(path string) (*ChunkStore, error) {
+	saved := &chunkStoreFile{}
+	if err := readJSON(path, saved); err != nil {
+		return nil, fmt.Errorf("invalid chunk store %s: %w", path, err)
+	}
+	s := &ChunkStore{
+		path:   path,
+		chunks: saved.Chunks,
+		files:  saved.Files,
+	}
+	if s.chunks == nil {
+		s.chunks = make(map[string][]ChunkRef)
+	}
+	if s.files == nil {
+		s.files = make(map[string]*cachedManifest)
+	}
+	return s, nil
+}
+
+// Manifest returns the manifest of the file at path, hashing it only when
+// its size or modification time changed since the last call, and adds its
+// chunks to the store.
+func (s *ChunkStore) Manifest(path string, chunkSize int64) (*SwarmManifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := path
+	if id, ok := fileIdentity(info); ok {
+		key = fmt.Sprintf("%d:%d", id.dev, id.ino)
+	}
+
+	s.lock.Lock()
+	cached, ok := s.files[key]
+	hit := ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) && cached.Manifest.ChunkSize == chunkSize
+	moved := hit && cached.Path != path
+	if moved {
+		cached.Path = path
+		s.dirty = true
+	}
+	s.lock.Unlock()
+	if hit {
+		log.Debugf("use cached chunk hashes. path:%s", path)
+		// a renamed file keeps its inode
+		if moved {
+			s.Add(path, cached.Manifest)
+		}
+		return cached.Manifest, nil
+	}
+
+	manifest, err := BuildSwarmManifest(path, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.files[key] = &cachedManifest{Path: path, Size: info.Size(), ModTime: info.ModTime(), Manifest: manifest}
+	s.dirty = true
+	s.lock.Unlock()
+	s.Add(path, manifest)
+	return manifest, nil
+}
+
+// Add records the chunks of the file at path.
+func (s *ChunkStore) Add(path string, manifest *SwarmManifest) {
+	for i, hash := range manifest.Chunks {
+		s.addChunk(hash, ChunkRef{Path: path, Offset: manifest.offset(i), Length: manifest.chunkLen(i)})
+	}
+}
+
+func (s *ChunkStore) addChunk(hash string, ref ChunkRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	refs := s.chunks[hash]
+	for _, r := range refs {
+		if r == ref {
+			return
+		}
+	}
+	refs = append(refs, ref)
+	if len(refs) > chunkStoreMaxRefs {
+		refs = refs[len(refs)-chunkStoreMaxRefs:]
+	}
+	s.chunks[hash] = refs
+	s.dirty = true
+}
+
+// Lookup returns where a chunk of length bytes is found, after checking it
+// still holds the data. A place that changed is dropped.
+func (s *ChunkStore) Lookup(hash string, length int64) (ChunkRef, []byte, bool) {
+	s.lock.Lock()
+	refs := append([]ChunkRef(nil), s.chunks[hash]...)
+	s.lock.Unlock()
+
+	for _, ref := range refs {
+		if ref.Length != length {
+			continue
+		}
+		data, err := readChunk(ref)
+		if err == nil {
+			sum := sha256.Sum256(data)
+			if hex.EncodeToString(sum[:]) == hash {
+				return ref, data, true
+			}
+		}
+		log.Debugf("drop stale chunk. hash:%s, path:%s, offset:%d", hash, ref.Path, ref.Offset)
+		s.remove(hash, ref)
+	}
+	return ChunkRef{}, nil, false
+}
+
+func (s *ChunkStore) remove(hash string, ref ChunkRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	refs := s.chunks[hash][:0]
+	for _, r := range s.chunks[hash] {
+		if r != ref {
+			refs = append(refs, r)
+		}
+	}
+	s.dirty = true
+	if len(refs) == 0 {
+		delete(s.chunks, hash)
+		return
+	}
+	s.chunks[hash] = refs
+}
+
+func readChunk(ref ChunkRef) ([]byte, error) {
+	f, err := os.Open(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, ref.Length)
+	if _, err := io.ReadFull(io.NewSectionReader(f, ref.Offset, ref.Length), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Prune forgets the files that are gone or changed since they were hashed,
+// and the chunks that no longer fit in their file, so the store only grows
+// with the files still on disk.
+func (s *ChunkStore) Prune() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sizes := make(map[string]int64)
+	size := func(path string) int64 {
+		if n, ok := sizes[path]; ok {
+			return n
+		}
+		n := int64(-1)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			n = info.Size()
+		}
+		sizes[path] = n
+		return n
+	}
+
+	for key, cached := range s.files {
+		info, err := os.Stat(cached.Path)
+		if err != nil || info.Size() != cached.Size || !info.ModTime().Equal(cached.ModTime) {
+			delete(s.files, key)
+			s.dirty = true
+		}
+	}
+	for hash, refs := range s.chunks {
+		kept := refs[:0]
+		for _, r := range refs {
+			if r.Offset+r.Length <= size(r.Path) {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == len(refs) {
+			continue
+		}
+		s.dirty = true
+		if len(kept) == 0 {
+			delete(s.chunks, hash)
+		} else {
+			s.chunks[hash] = kept
+		}
+	}
+}
+
+// Save prunes the store and writes it to its file, unless nothing changed.
+func (s *ChunkStore) Save() error {
+	s.Prune()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := writeJSON(s.path, &chunkStoreFile{Chunks: s.chunks, Files: s.files}); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
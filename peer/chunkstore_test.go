@@ -0,0 +1,134 @@
+package peer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChunkStoreManifestCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	os.WriteFile(path, bytes.Repeat([]byte("a"), 5000), 0644)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, modTime, modTime)
+
+	store, err := LoadChunkStore(filepath.Join(dir, "chunks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Manifest(path, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same size and time, the cached hashes are trusted
+	os.WriteFile(path, bytes.Repeat([]byte("b"), 5000), 0644)
+	os.Chtimes(path, modTime, modTime)
+	cached, _ := store.Manifest(path, 2000)
+	if cached.Hash != first.Hash {
+		t.Errorf("file hashed again")
+	}
+
+	os.Chtimes(path, modTime.Add(time.Second), modTime.Add(time.Second))
+	changed, _ := store.Manifest(path, 2000)
+	if changed.Hash == first.Hash {
+		t.Errorf("modified file not hashed again")
+	}
+
+	// a renamed file keeps its inode and its hashes
+	moved := filepath.Join(dir, "moved")
+	os.Rename(path, moved)
+	renamed, _ := store.Manifest(moved, 2000)
+	if renamed.Hash != changed.Hash {
+		t.Errorf("renamed file hashed again")
+	}
+	if ref, _, ok := store.Lookup(renamed.Chunks[0], 2000); !ok || ref.Path != moved {
+		t.Errorf("chunk of the renamed file not found")
+	}
+}
+
+func TestChunkStoreLookup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	data := append(bytes.Repeat([]byte("a"), 3000), bytes.Repeat([]byte("b"), 1000)...)
+	os.WriteFile(path, data, 0644)
+	manifest, err := BuildSwarmManifest(path, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ := LoadChunkStore(filepath.Join(dir, "chunks.json"))
+	store.Add(path, manifest)
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadChunkStore(filepath.Join(dir, "chunks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, chunk, ok := loaded.Lookup(manifest.Chunks[1], 1000)
+	if !ok || ref.Offset != 3000 || !bytes.Equal(chunk, data[3000:]) {
+		t.Fatalf("chunk 1 not found. ref:%v", ref)
+	}
+	if _, _, ok := loaded.Lookup(manifest.Chunks[1], 3000); ok {
+		t.Errorf("chunk found with the wrong length")
+	}
+
+	// a chunk whose data changed is dropped
+	os.WriteFile(path, bytes.Repeat([]byte("c"), 4000), 0644)
+	if _, _, ok := loaded.Lookup(manifest.Chunks[0], 3000); ok {
+		t.Errorf("stale chunk found")
+	}
+	if len(loaded.chunks[manifest.Chunks[0]]) != 0 {
+		t.Errorf("stale chunk kept")
+	}
+}
+
+func TestChunkStorePrune(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept")
+	gone := filepath.Join(dir, "gone")
+	short := filepath.Join(dir, "short")
+	for _, path := range []string{kept, gone, short} {
+		os.WriteFile(path, bytes.Repeat([]byte(filepath.Base(path)), 1000), 0644)
+	}
+
+	storePath := filepath.Join(dir, "chunks.json")
+	store, _ := LoadChunkStore(storePath)
+	for _, path := range []string{kept, gone, short} {
+		if _, err := store.Manifest(path, 2000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(gone)
+	os.WriteFile(short, []byte("s"), 0644)
+	store.Prune()
+	if len(store.files) != 1 || len(store.chunks) != 1 {
+		t.Fatalf("unexpected store. files:%d, chunks:%d", len(store.files), len(store.chunks))
+	}
+	for _, refs := range store.chunks {
+		if refs[0].Path != kept {
+			t.Errorf("unexpected chunk of %s", refs[0].Path)
+		}
+	}
+
+	// nothing changed since the last save, the file is not written again
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(storePath)
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(storePath); !os.IsNotExist(err) {
+		t.Errorf("unchanged store saved again")
+	}
+}
@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// Config holds the optional features of a BinaryConn. It can be loaded from
+// a json file with LoadConfig.
+type Config struct {
+	// DisplayName is shown to nearby peers found by mDNS.
+	DisplayName string `json:"display_name"`
+	// EnableMdns turns on discovery of p2faster peers on the local network.
+	EnableMdns bool `json:"enable_mdns"`
+	// Dht selects the DHT used to look peers up: DhtOff, DhtPrivate which is
+	// bootstrapped from our relay, or DhtPublic.
+	Dht string `json:"dht"`
+	// RelayId and RelayAddr locate the circuit relay, leave them empty to run
+	// without a relay and only use direct connections.
+	RelayId   string `json:"relay_id"`
+	RelayAddr string `json:"relay_addr"`
+	// ListenAddrs are the multiaddrs to listen on, libp2p picks random ports
+	// when it is empty.
+	ListenAddrs []string `json:"listen_addrs"`
+	// IdentityPath keeps the private key so the peer ID stays the same across
+	// restarts, a new ID is generated on every start when it is empty.
+	IdentityPath string `json:"identity_path"`
+	// AddressBookPath is the json file of known peers.
+	AddressBookPath string `json:"address_book_path"`
+	// UnknownPeers is the trust given to peers missing from the address book.
+	UnknownPeers TrustLevel `json:"unknown_peers"`
+	// RequireVerified refuses file transfers from peers whose short
+	// authentication string was not verified.
+	RequireVerified bool `json:"require_verified"`
+	// PrivateNetworkKeyPath points to a libp2p pre-shared key. When set only
+	// nodes holding the same key, relay included, can complete a handshake.
+	PrivateNetworkKeyPath string `json:"private_network_key_path"`
+	// Namespaces are registered at the relay on start, so members of the
+	// same namespace can list each other with NamespacePeers.
+	Namespaces []string `json:"namespaces"`
+	// RateLimits cap the bandwidth of file transfers, they can be changed
+	// later through RateLimiter.
+	RateLimits RateLimits `json:"rate_limits"`
+	// Metadata selects the file metadata sent with files and applied to the
+	// files we receive.
+	Metadata MetadataPolicy `json:"metadata"`
+	// Links is how directory sends treat symlinks: LinkFollow, LinkPreserve
+	// or LinkSkip.
+	Links LinkPolicy `json:"links"`
+	// MaxReceiveSize refuses offers of more bytes, 0 accepts any size that
+	// fits on the disk.
+	MaxReceiveSize int64 `json:"max_receive_size"`
+	// DeltaSync sends files as a delta against the copy the receiver
+	// already has at the destination, if any.
+	DeltaSync bool `json:"delta_sync"`
+	// ChunkStorePath keeps the hashes of the chunks we shared or downloaded,
+	// so swarm downloads skip the chunks we already hold. Empty disables it.
+	ChunkStorePath string `json:"chunk_store_path"`
+	// HistoryPath is the database of finished transfers, empty records
+	// nothing.
+	HistoryPath string `json:"history_path"`
+	// SyncDir keeps the synced folders and what was last synced in each.
+	SyncDir string `json:"sync_dir"`
+}
+
+func DefaultConfig() *Config {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "p2faster"
+	}
+	return &Config{
+		DisplayName: name,
+		EnableMdns:  true,
+		RelayId:     relayId,
+		RelayAddr:   relayIp,
+
+		IdentityPath:    filepath.Join(ConfigDir(), "identity.key"),
+		AddressBookPath: filepath.Join(ConfigDir(), "contacts.json"),
+		ChunkStorePath:  filepath.Join(ConfigDir(), "chunks.json"),
+		HistoryPath:     filepath.Join(ConfigDir(), "history.db"),
+		SyncDir:         filepath.Join(ConfigDir(), "sync"),
+		UnknownPeers:    TrustConfirm,
+		Metadata:        DefaultMetadataPolicy(),
+		Links:           LinkPreserve,
+	}
+}
+
+// LoadConfig reads the json config at path over the defaults, a missing file
+// gives the defaults.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ConfigDir is where p2faster keeps its files for the current user.
+func ConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "p2faster")
+}
+
+// LoadPrivateNetworkKey reads a libp2p pre-shared key in the swarm.key
+// format shared with ipfs.
+func LoadPrivateNetworkKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private network key %s: %w", path, err)
+	}
+	return psk, nil
+}
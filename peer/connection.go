@@ -3,6 +3,9 @@ package peer
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -25,20 +28,57 @@ const FileSendProtocol protocol.ID = "/sendStream"
 var log = logging.Logger("peer")
 
 type BinaryConn struct {
+	config       *Config
 	localNode    host.Host
 	relayInfo    *peer.AddrInfo
+	relayErr     error
 	peerInfo     *peer.AddrInfo
 	chatStream   network.Stream
+	swarm        *Swarm
+	folders      *FolderSync
+	lan          *lanDiscovery
+	routing      *peerRouting
+	book         *AddressBook
+	history      *History
+	gater        *connectionGater
 	onFileStream func(network.Stream)
 	onChatStream func(network.Stream)
 	onCreate     func(string)
+	onLanPeers   func([]LanPeer)
+	onConfirm    func(string) bool
+	onSync       func(SyncEvent)
+
+	onOfflineFile func(string, *OfflineFile) string
+
+	// lock guards closing and streams, transfers counts the transfers Close
+	// waits for
+	lock      sync.Mutex
+	closing   bool
+	streams   map[*transferStream]struct{}
+	transfers sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	namespaces map[string]context.CancelFunc
+	limiter    *RateLimiter
 }
 
 func CreateBinaryConn(onFileStream, onChatStream func(network.Stream), onCreate func(string)) *BinaryConn {
+	return CreateBinaryConnWithConfig(DefaultConfig(), onFileStream, onChatStream, onCreate)
+}
+
+func CreateBinaryConnWithConfig(config *Config, onFileStream, onChatStream func(network.Stream), onCreate func(string)) *BinaryConn {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &BinaryConn{
+		config:       config,
 		onFileStream: onFileStream,
 		onChatStream: onChatStream,
 		onCreate:     onCreate,
+		history:      CreateHistory(config.HistoryPath),
+		streams:      make(map[*transferStream]struct{}),
+		namespaces:   make(map[string]context.CancelFunc),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
@@ -51,76 +91,350 @@ func (c *BinaryConn) Init() error {
 	return nil
 }
 
-func (c *BinaryConn) Connect(peerId string) (network.Stream, error) {
-	if len(peerId) > 0 {
-		return c.connectPeer(peerId)
+// Connect opens the chat stream to a peer. target is either a peer ID, a full
+// multiaddr ending in /p2p/<peer id>, or <peer id>@<host>:<port>. The last two
+// are dialed directly without going through the relay.
+func (c *BinaryConn) Connect(target string) (network.Stream, error) {
+	if len(target) > 0 {
+		return c.connectPeer(target)
 	}
 	return nil, fmt.Errorf("invlied peer id")
 }
 
+// Dial connects to a peer without opening a chat session, for the
+// protocols that need no session like folder sync. target takes any form
+// Connect accepts, it returns the peer ID.
+func (c *BinaryConn) Dial(target string) (string, error) {
+	info, err := parseTarget(target)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.dialPeer(info)
+	return info.ID.String(), err
+}
+
+// Addrs returns the full multiaddrs other peers can dial us on.
+func (c *BinaryConn) Addrs() []string {
+	info := peer.AddrInfo{ID: c.localNode.ID(), Addrs: c.localNode.Addrs()}
+	addrs, err := peer.AddrInfoToP2pAddrs(&info)
+	if err != nil {
+		return nil
+	}
+
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, addr.String())
+	}
+	return result
+}
+
+// SetLanPeerHandler sets the callback invoked whenever the list of peers
+// found on the local network changes. It must be called before Init.
+func (c *BinaryConn) SetLanPeerHandler(onLanPeers func([]LanPeer)) {
+	c.onLanPeers = onLanPeers
+}
+
+// LanPeers returns the p2faster peers currently found on the local network.
+func (c *BinaryConn) LanPeers() []LanPeer {
+	if c.lan == nil {
+		return nil
+	}
+	return c.lan.Peers()
+}
+
+// SetConfirmHandler sets the callback asked whether to accept a chat session
+// from a peer whose trust level is TrustConfirm. Without it such sessions are
+// refused.
+func (c *BinaryConn) SetConfirmHandler(onConfirm func(peerId string) bool) {
+	c.onConfirm = onConfirm
+}
+
+// SetSyncHandler sets the callback told about every change applied to a
+// synced folder. It must be called before Init.
+func (c *BinaryConn) SetSyncHandler(onSync func(SyncEvent)) {
+	c.onSync = onSync
+}
+
+// FolderSync returns the folders kept in sync with peers.
+func (c *BinaryConn) FolderSync() *FolderSync {
+	return c.folders
+}
+
+// History returns the record of finished transfers.
+func (c *BinaryConn) History() *History {
+	return c.history
+}
+
+func (c *BinaryConn) AddressBook() *AddressBook {
+	return c.book
+}
+
+// PeerId returns the ID of the peer on the chat stream, or an empty string
+// when not connected.
+func (c *BinaryConn) PeerId() string {
+	if c.chatStream == nil {
+		return ""
+	}
+	return c.chatStream.Conn().RemotePeer().String()
+}
+
+// TransferAllowed reports whether files may be received from the peer.
+func (c *BinaryConn) TransferAllowed(peerId string) bool {
+	if !c.config.RequireVerified {
+		return true
+	}
+	contact, ok := c.book.Get(peerId)
+	return ok && contact.Verified
+}
+
 func (c *BinaryConn) CreateSendStream() (network.Stream, error) {
 	if c.chatStream == nil {
 		return nil, fmt.Errorf("invalid connecton")
 	}
-	s, err := c.localNode.NewStream(network.WithUseTransient(context.Background(), "sendStream"), c.chatStream.Conn().RemotePeer(), FileSendProtocol)
+	if c.isClosing() {
+		return nil, errClosing
+	}
+	s, err := c.localNode.NewStream(network.WithUseTransient(c.ctx, "sendStream"), c.chatStream.Conn().RemotePeer(), FileSendProtocol)
 	if err != nil {
 		log.Errorf("Whoops, this should have worked...: ", err)
 		return nil, err
 	}
 
-	return s, nil
+	tracked, err := c.trackStream(s)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return tracked, nil
+}
+
+// RateLimiter returns the bandwidth limits shared by the transfers of this
+// connection, pass it to Transmission.SetRateLimiter.
+func (c *BinaryConn) RateLimiter() *RateLimiter {
+	return c.limiter
+}
+
+// MetadataPolicy returns the file metadata to send and to apply.
+func (c *BinaryConn) MetadataPolicy() MetadataPolicy {
+	return c.config.Metadata
+}
+
+// LinkPolicy returns how directory sends treat symlinks.
+func (c *BinaryConn) LinkPolicy() LinkPolicy {
+	return c.config.Links
+}
+
+// DeltaSync tells if files are sent as deltas by default.
+func (c *BinaryConn) DeltaSync() bool {
+	return c.config.DeltaSync
+}
+
+// ShareFile serves the file at path to peers that download it by content hash.
+func (c *BinaryConn) ShareFile(path string) (*SwarmManifest, error) {
+	return c.swarm.Share(path)
+}
+
+// SwarmDownload fetches the file with the given content hash from every
+// connected peer that holds it.
+func (c *BinaryConn) SwarmDownload(hash, path string) error {
+	if err := c.beginTransfer(); err != nil {
+		return err
+	}
+	defer c.transfers.Done()
+	// the chunks come from several peers, the record names none of them
+	rec := c.startRecord(TransferReceive, "", filepath.Base(path), path, 0)
+	rec.Nickname = "swarm"
+	err := c.swarm.Download(c.ctx, hash, path, nil)
+	if err == nil {
+		rec.Hash = hash
+		if stat, statErr := os.Stat(path); statErr == nil {
+			rec.Size = stat.Size()
+		}
+	}
+	c.finishRecord(rec, nil, err)
+	return err
+}
+
+// StoreChunks records the chunks of a file received from a peer so a later
+// swarm download does not fetch them again. It reads the whole file.
+func (c *BinaryConn) StoreChunks(path string) {
+	if c.swarm != nil {
+		c.swarm.StoreFile(path)
+	}
 }
 
 func (c *BinaryConn) localInit() error {
 	var err error
-	c.localNode, err = libp2p.New(
+	c.limiter, err = CreateRateLimiter(c.config.RateLimits)
+	if err != nil {
+		log.Errorf("invalid rate limits. err:%v", err)
+		return err
+	}
+	go c.limiter.run(c.ctx)
+
+	c.book, err = LoadAddressBook(c.config.AddressBookPath)
+	if err != nil {
+		log.Errorf("load address book failed. path:%s, err:%v", c.config.AddressBookPath, err)
+		return err
+	}
+	c.gater = &connectionGater{
+		book:    c.book,
+		unknown: c.config.UnknownPeers,
+		relayId: c.config.RelayId,
+	}
+
+	opts := []libp2p.Option{
+		libp2p.ConnectionGater(c.gater),
 		libp2p.EnableNATService(),
 		libp2p.EnableRelayService(),
 		libp2p.EnableRelay(),
 		libp2p.EnableHolePunching(),
-	)
+	}
+	if len(c.config.ListenAddrs) > 0 {
+		opts = append(opts, libp2p.ListenAddrStrings(c.config.ListenAddrs...))
+	}
+	if len(c.config.PrivateNetworkKeyPath) > 0 {
+		if c.config.Dht == DhtPublic {
+			return fmt.Errorf("the public dht can't be used in a private network")
+		}
+		psk, err := LoadPrivateNetworkKey(c.config.PrivateNetworkKeyPath)
+		if err != nil {
+			log.Errorf("load private network key failed. err:%v", err)
+			return err
+		}
+		// quic can't run over a private network, libp2p falls back to tcp
+		// and websocket
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+	if len(c.config.IdentityPath) > 0 {
+		priv, err := LoadIdentity(c.config.IdentityPath)
+		if err != nil {
+			log.Errorf("load identity failed. path:%s, err:%v", c.config.IdentityPath, err)
+			return err
+		}
+		opts = append(opts, libp2p.Identity(priv))
+	}
+
+	c.localNode, err = libp2p.New(opts...)
 	if err != nil {
 		log.Infof("failed to create local host. err:%v", err)
 		return err
 	}
 	log.Infof("listen addresses:", c.localNode.Addrs())
 
-	c.relayInfo, err = connectRelay(c.localNode, relayId, relayIp)
-	if err != nil {
-		return err
+	var store *ChunkStore
+	if len(c.config.ChunkStorePath) > 0 {
+		loaded, err := LoadChunkStore(c.config.ChunkStorePath)
+		if err != nil {
+			log.Errorf("run without chunk store. err:%v", err)
+		} else {
+			store = loaded
+		}
+	}
+	c.swarm = CreateSwarmWithStore(c.localNode, store)
+	// the relay delivers offline files as soon as we connect to it
+	c.localNode.SetStreamHandler(MailboxDeliverProtocol, c.onMailboxStream)
+
+	var relays []peer.AddrInfo
+	if len(c.config.RelayId) > 0 {
+		c.relayInfo, err = connectRelay(c.localNode, c.config.RelayId, c.config.RelayAddr)
+		if err != nil {
+			c.relayErr = c.privateNetworkError(err)
+			log.Errorf("run without relay, only direct connections work. err:%v", c.relayErr)
+		} else {
+			relays = append(relays, *c.relayInfo)
+		}
 	}
 
 	c.localNode.SetStreamHandler(ChatProtocol, func(s network.Stream) {
 		log.Infof("get a chat stream.")
+		if c.isClosing() {
+			s.Reset()
+			return
+		}
+		if !c.confirmPeer(s.Conn().RemotePeer()) {
+			log.Infof("refuse chat stream. peer:%s", s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
 		c.chatStream = s
 		c.onChatStream(s)
 	})
 	c.localNode.SetStreamHandler(FileSendProtocol, func(s network.Stream) {
 		log.Infof("get a send stream.")
-		c.onFileStream(s)
+		if c.chatStream == nil || c.chatStream.Conn().RemotePeer() != s.Conn().RemotePeer() {
+			log.Infof("refuse send stream from peer without a chat session. peer:%s", s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		if !c.TransferAllowed(s.Conn().RemotePeer().String()) {
+			log.Infof("refuse send stream from unverified peer. peer:%s", s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		tracked, err := c.trackStream(s)
+		if err != nil {
+			log.Infof("refuse send stream while closing. peer:%s", s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		c.onFileStream(tracked)
 	})
 
+	if c.config.Dht != DhtOff {
+		if c.config.UnknownPeers == TrustBlocked {
+			log.Warnf("unknown peers are blocked, the dht can only use peers in the address book.")
+		}
+		c.routing, err = createPeerRouting(c.localNode, c.config.Dht, relays)
+		if err != nil {
+			log.Errorf("start dht failed. mode:%s, err:%v", c.config.Dht, err)
+		}
+	}
+
+	if c.config.EnableMdns {
+		c.lan = createLanDiscovery(c.localNode, c.config.DisplayName, c.onLanPeers)
+		if err := c.lan.Start(); err != nil {
+			log.Errorf("start mdns discovery failed. err:%v", err)
+			c.lan = nil
+		}
+	}
+
+	c.folders = createFolderSync(c, c.config.SyncDir, c.onSync)
+	if err := c.folders.Start(); err != nil {
+		log.Errorf("start folder sync failed. err:%v", err)
+	}
+
+	for _, namespace := range c.config.Namespaces {
+		if err := c.Register(namespace); err != nil {
+			log.Errorf("register in namespace failed. namespace:%s, err:%v", namespace, err)
+		}
+	}
+
 	c.onCreate(c.localNode.ID().String())
 	return nil
 }
 
-func (c *BinaryConn) connectPeer(peerId string) (network.Stream, error) {
+func (c *BinaryConn) connectPeer(target string) (network.Stream, error) {
 	if c.chatStream != nil {
 		return nil, fmt.Errorf("already connected")
 	}
-	relayaddr, err := ma.NewMultiaddr("/p2p/" + c.relayInfo.ID.String() + "/p2p-circuit/p2p/" + peerId)
+	if c.isClosing() {
+		return nil, errClosing
+	}
+	info, err := parseTarget(target)
 	if err != nil {
-		log.Errorf("connect to peer failed. err:%v", err)
+		log.Errorf("parse peer address failed. target:%s, err:%v", target, err)
 		return nil, err
 	}
 
-	c.peerInfo, _ = peer.AddrInfoFromP2pAddr(relayaddr)
-	if err := c.localNode.Connect(context.Background(), *c.peerInfo); err != nil {
-		log.Errorf("Unexpected error here. Failed to connect unreachable1 and unreachable2: %v", err)
+	relayed, err := c.dialPeer(info)
+	if err != nil {
 		return nil, err
 	}
 
-	time.Sleep(time.Duration(5) * time.Second)
+	if relayed {
+		time.Sleep(time.Duration(5) * time.Second)
+	}
 
 	s, err := c.localNode.NewStream(network.WithUseTransient(context.Background(), "chatStream"), c.peerInfo.ID, ChatProtocol)
 	if err != nil {
@@ -131,16 +445,137 @@ func (c *BinaryConn) connectPeer(peerId string) (network.Stream, error) {
 	return s, nil
 }
 
+// dialPeer connects to the peer, preferring the given address, then a direct
+// LAN or DHT address over a relay circuit. It reports whether the connection
+// is relayed.
+func (c *BinaryConn) dialPeer(target peer.AddrInfo) (bool, error) {
+	id := target.ID
+	if len(target.Addrs) > 0 {
+		log.Infof("dial peer directly. peer:%s, addrs:%v", id, target.Addrs)
+		c.peerInfo = &target
+		if err := c.localNode.Connect(context.Background(), target); err != nil {
+			log.Errorf("dial peer failed. peer:%s, err:%v", id, err)
+			return false, c.privateNetworkError(err)
+		}
+		return c.relayedOnly(id), nil
+	}
+
+	// the cached entry may be stale, the peer is then looked up as if it
+	// was not on the local network
+	if info, ok := c.lanPeer(id); ok {
+		log.Infof("peer is on the local network, dial directly. peer:%s", id)
+		c.peerInfo = &info
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.localNode.Connect(ctx, info)
+		cancel()
+		if err == nil {
+			return false, nil
+		}
+		log.Infof("dial peer on the local network failed. peer:%s, addrs:%v, err:%v", id, info.Addrs, err)
+	}
+
+	if c.routing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		info, err := c.routing.FindPeer(ctx, id)
+		cancel()
+		if err != nil {
+			log.Infof("find peer in dht failed. peer:%s, err:%v", id, err)
+		} else {
+			direct, relayed := splitCircuitAddrs(info.Addrs)
+			for _, addrs := range [][]ma.Multiaddr{direct, relayed} {
+				if len(addrs) == 0 {
+					continue
+				}
+				c.peerInfo = &peer.AddrInfo{ID: id, Addrs: addrs}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				err := c.localNode.Connect(ctx, *c.peerInfo)
+				cancel()
+				if err == nil {
+					log.Infof("connect to peer found in dht. peer:%s, addrs:%v", id, addrs)
+					return c.relayedOnly(id), nil
+				}
+				log.Infof("dial peer found in dht failed. peer:%s, addrs:%v, err:%v", id, addrs, err)
+			}
+		}
+	}
+
+	if c.relayInfo == nil {
+		if c.relayErr != nil {
+			return false, fmt.Errorf("no relay to reach peer %s: %w", id, c.relayErr)
+		}
+		return false, fmt.Errorf("no relay to reach peer %s", id)
+	}
+	relayaddr, err := ma.NewMultiaddr("/p2p/" + c.relayInfo.ID.String() + "/p2p-circuit/p2p/" + id.String())
+	if err != nil {
+		log.Errorf("connect to peer failed. err:%v", err)
+		return false, err
+	}
+	c.peerInfo, _ = peer.AddrInfoFromP2pAddr(relayaddr)
+	if err := c.localNode.Connect(context.Background(), *c.peerInfo); err != nil {
+		log.Errorf("Unexpected error here. Failed to connect unreachable1 and unreachable2: %v", err)
+		return false, c.privateNetworkError(err)
+	}
+	return true, nil
+}
+
+// relayedOnly tells if the connections to id all go through a relay, the
+// addresses dialed may mix direct and circuit ones.
+func (c *BinaryConn) relayedOnly(id peer.ID) bool {
+	for _, conn := range c.localNode.Network().ConnsToPeer(id) {
+		if !conn.Stat().Transient {
+			return false
+		}
+	}
+	return true
+}
+
+// privateNetworkError explains a failed dial when we run a private network,
+// a key mismatch looks like any failed handshake from our side.
+func (c *BinaryConn) privateNetworkError(err error) error {
+	if len(c.config.PrivateNetworkKeyPath) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (check the remote node uses the same private network key as %s)", err, c.config.PrivateNetworkKeyPath)
+}
+
+func (c *BinaryConn) confirmPeer(p peer.ID) bool {
+	switch c.gater.trust(p) {
+	case TrustTrusted:
+		return true
+	case TrustConfirm:
+		if c.onConfirm == nil {
+			log.Infof("no confirm handler for peer. peer:%s", p)
+			return false
+		}
+		return c.onConfirm(p.String())
+	default:
+		return false
+	}
+}
+
+func (c *BinaryConn) lanPeer(id peer.ID) (peer.AddrInfo, bool) {
+	if c.lan == nil {
+		return peer.AddrInfo{}, false
+	}
+	return c.lan.lookup(id)
+}
+
 func connectRelay(host host.Host, relayId, relayAddr string) (*peer.AddrInfo, error) {
-	ms1, _ := ma.NewMultiaddr(fmt.Sprintf("%s/p2p/%v", relayAddr, relayId))
-	relayInfo, _ := peer.AddrInfoFromP2pAddr(ms1)
+	ms1, err := ma.NewMultiaddr(fmt.Sprintf("%s/p2p/%v", relayAddr, relayId))
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %s: %w", relayAddr, err)
+	}
+	relayInfo, err := peer.AddrInfoFromP2pAddr(ms1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address %s: %w", relayAddr, err)
+	}
 
 	if err := host.Connect(context.Background(), *relayInfo); err != nil {
 		log.Errorf("failed to connect relay server. addr:%s, err: %v", relayAddr, err)
 		return nil, err
 	}
 
-	_, err := client.Reserve(context.Background(), host, *relayInfo)
+	_, err = client.Reserve(context.Background(), host, *relayInfo)
 	if err != nil {
 		log.Errorf("failed to receive a relay. addr:%s, err:%v", relayAddr, err)
 		return nil, err
@@ -0,0 +1,429 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	deltaMinBlockSize = 4 * 1024
+	deltaMaxBlockSize = 1024 * 1024
+	// literals are flushed in records of at most this size
+	deltaMaxLiteral = 64 * 1024
+)
+
+// delta ops sent by the sender, the end op is followed by the sha256 of the
+// whole new file
+const (
+	deltaOpCopy    = 'C'
+	deltaOpLiteral = 'L'
+	deltaOpEnd     = 'E'
+)
+
+// DeltaBlock is the signature of a block of the receiver's file: an rsync
+// rolling checksum to find candidates and a sha256 to confirm them.
+type DeltaBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// deltaSignature is what the receiver already has, no blocks ask for a full
+// send.
+type deltaSignature struct {
+	BlockSize int64        `json:"block_size"`
+	Size      int64        `json:"size"`
+	Blocks    []DeltaBlock `json:"blocks"`
+}
+
+// deltaBlockSize grows with the square root of the file so the signature of
+// a big file stays small.
+func deltaBlockSize(size int64) int64 {
+	blockSize := int64(deltaMinBlockSize)
+	for blockSize < deltaMaxBlockSize && blockSize*blockSize < size {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+// rollingSum is the rsync weak checksum of a window of data.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(data []byte) rollingSum {
+	s := rollingSum{n: uint32(len(data))}
+	for i, c := range data {
+		s.a += uint32(c)
+		s.b += uint32(len(data)-i) * uint32(c)
+	}
+	return s
+}
+
+// roll moves the window one byte forward.
+func (s *rollingSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s rollingSum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+func readSignature(path string) (*deltaSignature, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &deltaSignature{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return &deltaSignature{}, nil
+	}
+
+	sig := &deltaSignature{BlockSize: deltaBlockSize(info.Size()), Size: info.Size()}
+	r := bufio.NewReaderSize(f, deltaMaxBlockSize)
+	block := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			strong := sha256.Sum256(block[:n])
+			sig.Blocks = append(sig.Blocks, DeltaBlock{Weak: newRollingSum(block[:n]).sum(), Strong: strong[:]})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// RecvFileDelta sends the signature of the file already at path, if any,
+// then rebuilds the new version from its blocks and the data the sender is
+// missing. The result replaces the file once its hash is verified.
+func (t *Transmission) RecvFileDelta(path string) error {
+	sig, err := readSignature(path)
+	if err != nil {
+		log.Errorf("read delta base failed, send it all. path:%s, err:%v", path, err)
+		sig = &deltaSignature{}
+	}
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return err
+	}
+	if err := t.write(data); err != nil {
+		return err
+	}
+	if len(sig.Blocks) == 0 {
+		return t.RecvFile(path)
+	}
+	log.Infof("recv file delta. path:%s, blocks:%d, block size:%d", path, len(sig.Blocks), sig.BlockSize)
+
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+	if err := t.recvDelta(path, sig); err != nil {
+		log.Errorf("receive file delta failed. path:%s, err:%v", path, err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	if err := ApplyFileMeta(path, t.meta, t.policy); err != nil {
+		log.Errorf("apply file metadata failed. path:%s, err:%v", path, err)
+	}
+	return nil
+}
+
+func (t *Transmission) recvDelta(path string, sig *deltaSignature) error {
+	base, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	tmp := path + ".delta.part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return diskError(err)
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	r := bufio.NewReader(transmissionReader{t})
+	w := bufio.NewWriterSize(out, deltaMaxBlockSize)
+	hash := sha256.New()
+	dst := io.MultiWriter(w, hash)
+	block := make([]byte, sig.BlockSize)
+	var copied, literal int64
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case deltaOpCopy:
+			index, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if index >= uint64(len(sig.Blocks)) {
+				return fmt.Errorf("invalid block %d", index)
+			}
+			n, err := base.ReadAt(block, int64(index)*sig.BlockSize)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err := t.receiving(int64(n)); err != nil {
+				return err
+			}
+			if _, err := dst.Write(block[:n]); err != nil {
+				return diskError(err)
+			}
+			copied += int64(n)
+		case deltaOpLiteral:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if length > deltaMaxLiteral {
+				return fmt.Errorf("invalid literal of %d bytes", length)
+			}
+			if err := t.receiving(int64(length)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(dst, r, int64(length)); err != nil {
+				return diskError(err)
+			}
+			literal += int64(length)
+		case deltaOpEnd:
+			if err := t.checkHash(r, hash); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return diskError(err)
+			}
+			if err := out.Close(); err != nil {
+				return diskError(err)
+			}
+			log.Infof("rebuild file from delta. path:%s, copied:%d, received:%d", path, copied, literal)
+			return os.Rename(tmp, path)
+		default:
+			return fmt.Errorf("unknown delta op %q", op)
+		}
+	}
+}
+
+// SendFileDelta reads the signature of the receiver's copy and sends only
+// the data it is missing, or the whole file when it has none.
+func (t *Transmission) SendFileDelta(path string) error {
+	sig := &deltaSignature{}
+	if err := json.NewDecoder(t.rw).Decode(sig); err != nil {
+		log.Errorf("read delta signature failed. err:%v", err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	if len(sig.Blocks) == 0 {
+		return t.SendFile(path)
+	}
+	if sig.BlockSize < deltaMinBlockSize || sig.BlockSize > deltaMaxBlockSize {
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return fmt.Errorf("invalid delta block size %d", sig.BlockSize)
+	}
+
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("open file failed. err:%v", err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriterSize(transmissionWriter{t}, deltaMaxLiteral+binary.MaxVarintLen64+1)
+	if t.sum, err = sendDelta(f, sig, w); err != nil {
+		log.Errorf("send file delta failed. path:%s, err:%v", path, err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	return w.Flush()
+}
+
+// sendDelta scans r for the blocks of the signature with the rolling
+// checksum and writes copy ops for them, literal ops for the rest. It
+// returns the sha256 of r.
+func sendDelta(r io.Reader, sig *deltaSignature, w io.Writer) ([]byte, error) {
+	blocks := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		blocks[b.Weak] = append(blocks[b.Weak], i)
+	}
+	// the last block may be shorter than the others
+	lastSize := sig.Size - int64(len(sig.Blocks)-1)*sig.BlockSize
+
+	e := &deltaEncoder{w: w, hash: sha256.New()}
+	bs := int(sig.BlockSize)
+	buf := make([]byte, 0, 4*bs)
+	start := 0
+	eof := false
+	var sum rollingSum
+	rolled := false
+	for {
+		// keep a block and the next byte ahead when the data goes on
+		if !eof && len(buf)-start < bs+1 {
+			buf = buf[:copy(buf[:cap(buf)], buf[start:])]
+			start = 0
+			for !eof && len(buf) < cap(buf) {
+				n, err := r.Read(buf[len(buf):cap(buf)])
+				buf = buf[:len(buf)+n]
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		avail := len(buf) - start
+		if avail == 0 {
+			break
+		}
+		if avail < bs {
+			tail := buf[start:]
+			if int64(avail) == lastSize && bytes.Equal(sha256Sum(tail), sig.Blocks[len(sig.Blocks)-1].Strong) {
+				if err := e.copy(len(sig.Blocks)-1, tail); err != nil {
+					return nil, err
+				}
+			} else if err := e.literal(tail); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		window := buf[start : start+bs]
+		if !rolled {
+			sum = newRollingSum(window)
+			rolled = true
+		}
+		if candidates, ok := blocks[sum.sum()]; ok {
+			strong := sha256Sum(window)
+			if index, ok := matchBlock(sig, candidates, strong, bs); ok {
+				if err := e.copy(index, window); err != nil {
+					return nil, err
+				}
+				start += bs
+				rolled = false
+				continue
+			}
+		}
+
+		if err := e.literal(buf[start : start+1]); err != nil {
+			return nil, err
+		}
+		if avail > bs {
+			sum.roll(buf[start], buf[start+bs])
+		} else {
+			rolled = false
+		}
+		start++
+	}
+	if err := e.end(); err != nil {
+		return nil, err
+	}
+	return e.hash.Sum(nil), nil
+}
+
+func matchBlock(sig *deltaSignature, candidates []int, strong []byte, size int) (int, bool) {
+	for _, i := range candidates {
+		// a short last block can not match a full window
+		if i == len(sig.Blocks)-1 && sig.Size-int64(i)*sig.BlockSize != int64(size) {
+			continue
+		}
+		if bytes.Equal(sig.Blocks[i].Strong, strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// deltaEncoder writes delta ops, gathering literal bytes into records.
+type deltaEncoder struct {
+	w       io.Writer
+	hash    hash.Hash
+	pending []byte
+}
+
+func (e *deltaEncoder) literal(data []byte) error {
+	e.hash.Write(data)
+	e.pending = append(e.pending, data...)
+	if len(e.pending) >= deltaMaxLiteral {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *deltaEncoder) copy(index int, data []byte) error {
+	e.hash.Write(data)
+	if err := e.flush(); err != nil {
+		return err
+	}
+	op := binary.AppendUvarint([]byte{deltaOpCopy}, uint64(index))
+	_, err := e.w.Write(op)
+	return err
+}
+
+func (e *deltaEncoder) flush() error {
+	for len(e.pending) > 0 {
+		n := len(e.pending)
+		if n > deltaMaxLiteral {
+			n = deltaMaxLiteral
+		}
+		op := binary.AppendUvarint([]byte{deltaOpLiteral}, uint64(n))
+		if _, err := e.w.Write(append(op, e.pending[:n]...)); err != nil {
+			return err
+		}
+		e.pending = e.pending[n:]
+	}
+	e.pending = e.pending[:0]
+	return nil
+}
+
+func (e *deltaEncoder) end() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	_, err := e.w.Write(append([]byte{deltaOpEnd}, e.hash.Sum(nil)...))
+	return err
+}
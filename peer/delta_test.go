@@ -0,0 +1,92 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.w.Write(p)
+}
+
+// deltaPair connects a sender and a receiver in both directions, sent
+// counts the bytes from the sender.
+func deltaPair() (sender, receiver *Transmission, sent *countingWriter) {
+	toReceiver, fromSender := io.Pipe()
+	toSender, fromReceiver := io.Pipe()
+	sent = &countingWriter{w: fromSender}
+	sender = CreateTransmissionWithBufio(bufio.NewReadWriter(bufio.NewReader(toSender), bufio.NewWriter(sent)))
+	receiver = CreateTransmissionWithBufio(bufio.NewReadWriter(bufio.NewReader(toReceiver), bufio.NewWriter(fromReceiver)))
+	return sender, receiver, sent
+}
+
+func TestRollingSum(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	sum := newRollingSum(data[:100])
+	for i := 0; i < 900; i++ {
+		sum.roll(data[i], data[i+100])
+		if want := newRollingSum(data[i+1 : i+101]); sum.sum() != want.sum() {
+			t.Fatalf("rolled sum differs at %d", i+1)
+		}
+	}
+}
+
+func TestFileDelta(t *testing.T) {
+	dir := t.TempDir()
+	old := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(2)).Read(old)
+	// the new version inserts and changes a few bytes in the middle
+	changed := append(append(append([]byte{}, old[:1<<20]...), []byte("inserted")...), old[1<<20:]...)
+	copy(changed[2<<20:], "changed")
+
+	src := filepath.Join(dir, "new")
+	dst := filepath.Join(dir, "old")
+	os.WriteFile(src, changed, 0644)
+	os.WriteFile(dst, old, 0644)
+
+	sender, receiver, sent := deltaPair()
+	errs := make(chan error, 1)
+	go func() { errs <- sender.SendFileDelta(src) }()
+	if err := receiver.RecvFileDelta(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := os.ReadFile(dst)
+	if !bytes.Equal(got, changed) {
+		t.Fatalf("rebuilt file differs")
+	}
+	if sent.n > int64(len(changed))/10 {
+		t.Errorf("sent %d bytes for a small change", sent.n)
+	}
+}
+
+func TestFileDeltaWithoutBase(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "new")
+	os.WriteFile(src, []byte("whole file"), 0644)
+
+	sender, receiver, _ := deltaPair()
+	go sender.SendFileDelta(src)
+	dst := filepath.Join(dir, "missing")
+	if err := receiver.RecvFileDelta(dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "whole file" {
+		t.Errorf("unexpected content %q", got)
+	}
+}
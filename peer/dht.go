@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	DhtOff     = ""
+	DhtPrivate = "private"
+	DhtPublic  = "public"
+)
+
+// DhtProtocolPrefix separates the private p2faster DHT from the public one.
+const DhtProtocolPrefix protocol.ID = "/p2faster"
+
+const dhtPublishInterval = 10 * time.Minute
+
+// peerRouting looks peers up in a Kademlia DHT. Every node publishes a
+// provider record for its own ID, so peers that are not DHT servers
+// themselves can still be found with their current addresses and relays.
+type peerRouting struct {
+	host   host.Host
+	dht    *dht.IpfsDHT
+	cancel context.CancelFunc
+}
+
+func createPeerRouting(h host.Host, mode string, relays []peer.AddrInfo) (*peerRouting, error) {
+	var opts []dht.Option
+	switch mode {
+	case DhtPrivate:
+		opts = append(opts,
+			dht.ProtocolPrefix(DhtProtocolPrefix),
+			dht.BootstrapPeers(relays...),
+		)
+	case DhtPublic:
+		opts = append(opts, dht.BootstrapPeers(dht.GetDefaultBootstrapPeerAddrInfos()...))
+	default:
+		return nil, fmt.Errorf("unknown dht mode %q", mode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := dht.New(ctx, h, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := d.Bootstrap(ctx); err != nil {
+		cancel()
+		d.Close()
+		return nil, err
+	}
+
+	r := &peerRouting{
+		host:   h,
+		dht:    d,
+		cancel: cancel,
+	}
+	go r.publish(ctx)
+	return r, nil
+}
+
+// FindPeer returns the addresses of id known to the DHT, including the
+// circuit addresses of the relays it has reserved a slot on.
+func (r *peerRouting) FindPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
+	info, err := r.dht.FindPeer(ctx, id)
+	if err == nil && len(info.Addrs) > 0 {
+		return info, nil
+	}
+
+	key, err := peerRecordKey(id)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	for provider := range r.dht.FindProvidersAsync(ctx, key, 0) {
+		if provider.ID == id && len(provider.Addrs) > 0 {
+			return provider, nil
+		}
+	}
+	return peer.AddrInfo{}, fmt.Errorf("peer %s not found in dht", id)
+}
+
+func (r *peerRouting) Close() error {
+	r.cancel()
+	return r.dht.Close()
+}
+
+func (r *peerRouting) publish(ctx context.Context) {
+	key, err := peerRecordKey(r.host.ID())
+	if err != nil {
+		log.Errorf("build peer record key failed. err:%v", err)
+		return
+	}
+
+	ticker := time.NewTicker(dhtPublishInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.dht.Provide(ctx, key, true); err != nil {
+			log.Debugf("publish peer record failed. err:%v", err)
+		} else {
+			log.Debugf("publish peer record. addrs:%v", r.host.Addrs())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func peerRecordKey(id peer.ID) (cid.Cid, error) {
+	hash, err := mh.Sum([]byte("p2faster/peer/"+id.String()), mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, hash), nil
+}
+
+// splitCircuitAddrs separates the addresses that can be dialed directly from
+// the ones going through a relay.
+func splitCircuitAddrs(addrs []ma.Multiaddr) (direct, relayed []ma.Multiaddr) {
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			relayed = append(relayed, addr)
+		} else {
+			direct = append(direct, addr)
+		}
+	}
+	return direct, relayed
+}
@@ -0,0 +1,494 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LinkPolicy tells how a directory send treats the symlinks of the tree.
+type LinkPolicy string
+
+const (
+	// LinkFollow sends the file or directory a symlink points to.
+	LinkFollow LinkPolicy = "follow"
+	// LinkPreserve sends symlinks as links when their target stays inside
+	// the tree, the others are skipped.
+	LinkPreserve LinkPolicy = "preserve"
+	// LinkSkip leaves every symlink out.
+	LinkSkip LinkPolicy = "skip"
+)
+
+const (
+	DirEntryFile     = "file"
+	DirEntryDir      = "dir"
+	DirEntrySymlink  = "symlink"
+	DirEntryHardlink = "hardlink"
+)
+
+// DirEntry is a node of a directory send. Path is relative to the root with
+// slash separators, Target is the link text of a symlink or the Path of the
+// first entry sharing the inode of a hardlink.
+type DirEntry struct {
+	Path   string    `json:"path"`
+	Type   string    `json:"type"`
+	Size   int64     `json:"size,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Meta   *FileMeta `json:"meta,omitempty"`
+
+	source string
+}
+
+// DirManifest lists a directory tree, parents before their children. The
+// content of the file entries follows it on the stream in the same order.
+type DirManifest struct {
+	Entries []DirEntry `json:"entries"`
+}
+
+// Size is the number of content bytes of the send.
+func (m *DirManifest) Size() int64 {
+	var size int64
+	for _, e := range m.Entries {
+		if e.Type == DirEntryFile {
+			size += e.Size
+		}
+	}
+	return size
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+type dirWalker struct {
+	root    string
+	links   LinkPolicy
+	policy  MetadataPolicy
+	inodes  map[inode]string
+	visited map[string]bool
+	entries []DirEntry
+}
+
+// BuildDirManifest walks the tree at root. Hardlinked files are sent once,
+// FIFOs, sockets and devices are skipped with a warning.
+func BuildDirManifest(root string, links LinkPolicy, policy MetadataPolicy) (*DirManifest, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	w := &dirWalker{
+		root:    root,
+		links:   links,
+		policy:  policy,
+		inodes:  make(map[inode]string),
+		visited: make(map[string]bool),
+	}
+	w.visit(root)
+	if err := w.walkDir(root, ""); err != nil {
+		return nil, err
+	}
+	return &DirManifest{Entries: w.entries}, nil
+}
+
+func (w *dirWalker) walkDir(dir, rel string) error {
+	children, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := w.add(filepath.Join(dir, child.Name()), path.Join(rel, child.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *dirWalker) add(source, rel string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch w.links {
+		case LinkFollow:
+			followed, err := os.Stat(source)
+			if err != nil {
+				log.Warnf("skip broken symlink. path:%s, err:%v", source, err)
+				return nil
+			}
+			info = followed
+		case LinkPreserve:
+			target, ok := w.linkTarget(source)
+			if !ok {
+				log.Warnf("skip symlink pointing outside of the tree. path:%s", source)
+				return nil
+			}
+			w.entries = append(w.entries, DirEntry{Path: rel, Type: DirEntrySymlink, Target: target})
+			return nil
+		default:
+			log.Infof("skip symlink. path:%s", source)
+			return nil
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		if !w.visit(source) {
+			log.Warnf("skip directory already sent, symlink loop. path:%s", source)
+			return nil
+		}
+		w.entries = append(w.entries, DirEntry{Path: rel, Type: DirEntryDir, Meta: fileMeta(source, info, w.policy)})
+		return w.walkDir(source, rel)
+	case info.Mode().IsRegular():
+		if id, ok := fileInode(info); ok {
+			if first, ok := w.inodes[id]; ok {
+				w.entries = append(w.entries, DirEntry{Path: rel, Type: DirEntryHardlink, Target: first})
+				return nil
+			}
+			w.inodes[id] = rel
+		}
+		w.entries = append(w.entries, DirEntry{
+			Path:   rel,
+			Type:   DirEntryFile,
+			Size:   info.Size(),
+			Meta:   fileMeta(source, info, w.policy),
+			source: source,
+		})
+		return nil
+	default:
+		log.Warnf("skip special file. path:%s, mode:%v", source, info.Mode())
+		return nil
+	}
+}
+
+// visit records a directory, it returns false when it was already walked
+// through another symlink.
+func (w *dirWalker) visit(dir string) bool {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return true
+	}
+	if w.visited[real] {
+		return false
+	}
+	w.visited[real] = true
+	return true
+}
+
+// linkTarget returns the target of the symlink at source relative to its
+// directory, when it resolves inside the root.
+func (w *dirWalker) linkTarget(source string) (string, bool) {
+	target, err := os.Readlink(source)
+	if err != nil {
+		return "", false
+	}
+	resolved := target
+	if !filepath.IsAbs(target) {
+		resolved = filepath.Join(filepath.Dir(source), target)
+	}
+	if !withinDir(w.root, resolved) {
+		return "", false
+	}
+	// a target inside the tree may still lead out through other links
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		realRoot, err := filepath.EvalSymlinks(w.root)
+		if err != nil || !withinDir(realRoot, real) {
+			return "", false
+		}
+	}
+
+	relative, err := filepath.Rel(filepath.Dir(source), resolved)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(relative), true
+}
+
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// SendDir sends the manifest, the content of its files, which must not
+// change size in between, then the hash of that content.
+func (t *Transmission) SendDir(root string, manifest *DirManifest) error {
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		log.Errorf("encode directory manifest failed. err:%v", err)
+		return err
+	}
+	if err := t.write(data); err != nil {
+		log.Errorf("send directory manifest failed. err:%v", err)
+		return err
+	}
+	hash := sha256.New()
+	for _, e := range manifest.Entries {
+		if e.Type != DirEntryFile {
+			continue
+		}
+		if err := t.sendEntry(root, e, hash); err != nil {
+			log.Errorf("send file failed, abort the directory. path:%s, err:%v", e.Path, err)
+			if t.stream != nil {
+				t.stream.Reset()
+			}
+			return err
+		}
+	}
+	t.sum = hash.Sum(nil)
+	return t.write(t.sum)
+}
+
+func (t *Transmission) sendEntry(root string, e DirEntry, hash io.Writer) error {
+	source := e.source
+	if source == "" {
+		source = filepath.Join(root, filepath.FromSlash(e.Path))
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.CopyN(io.MultiWriter(transmissionWriter{t}, hash), f, e.Size)
+	if err == io.EOF {
+		return fmt.Errorf("file shrank to %d bytes", n)
+	}
+	return err
+}
+
+// RecvDir receives a directory send into root. Nothing is ever written
+// through a symlink: entries whose parent is not a plain directory inside
+// root are refused, and symlinks are created once all content is written.
+func (t *Transmission) RecvDir(root string) error {
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+
+	decoder := json.NewDecoder(t.rw)
+	manifest := &DirManifest{}
+	if err := decoder.Decode(manifest); err != nil {
+		log.Errorf("read directory manifest failed. err:%v", err)
+		return err
+	}
+	if err := t.checkSize(manifest.Size()); err != nil {
+		log.Errorf("refuse directory manifest. err:%v", err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		log.Errorf("create directory failed. err:%v", err)
+		return diskError(err)
+	}
+
+	r := io.MultiReader(decoder.Buffered(), transmissionReader{t})
+	hash := sha256.New()
+	err := t.receiveDir(root, manifest, io.TeeReader(r, hash))
+	if err == nil {
+		err = t.checkHash(r, hash)
+	}
+	if err != nil {
+		log.Errorf("receive directory failed. root:%s, err:%v", root, err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+	}
+	return err
+}
+
+func (t *Transmission) receiveDir(root string, manifest *DirManifest, r io.Reader) error {
+	var dirs, symlinks []DirEntry
+	links := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		if e.Type == DirEntrySymlink {
+			links[e.Path] = true
+		}
+	}
+	for _, e := range manifest.Entries {
+		dest, err := receivePath(root, e.Path)
+		if err != nil {
+			return err
+		}
+
+		switch e.Type {
+		case DirEntryDir:
+			if err := os.Mkdir(dest, 0755); err != nil && !os.IsExist(err) {
+				return diskError(err)
+			}
+			if info, err := os.Lstat(dest); err != nil || !info.IsDir() {
+				return fmt.Errorf("%w: %s is not a directory", ErrPathRejected, e.Path)
+			}
+			dirs = append(dirs, e)
+		case DirEntryFile:
+			if err := t.receiving(e.Size); err != nil {
+				return err
+			}
+			if err := receiveEntry(dest, e.Size, r); err != nil {
+				return err
+			}
+			if err := ApplyFileMeta(dest, e.Meta, t.policy); err != nil {
+				log.Errorf("apply file metadata failed. path:%s, err:%v", dest, err)
+			}
+		case DirEntryHardlink:
+			target, err := receivePath(root, e.Target)
+			if err != nil {
+				return err
+			}
+			if info, err := os.Lstat(target); err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("%w: hardlink %s to a missing file", ErrPathRejected, e.Path)
+			}
+			if err := removeFile(dest); err != nil {
+				return err
+			}
+			if err := os.Link(target, dest); err != nil {
+				return err
+			}
+		case DirEntrySymlink:
+			if !validLinkTarget(root, e.Path, e.Target, links) {
+				return fmt.Errorf("%w: symlink %s points outside of the root", ErrPathRejected, e.Path)
+			}
+			symlinks = append(symlinks, e)
+		default:
+			return fmt.Errorf("unknown entry type %q", e.Type)
+		}
+	}
+
+	for _, e := range symlinks {
+		dest, err := receivePath(root, e.Path)
+		if err != nil {
+			return err
+		}
+		if err := removeFile(dest); err != nil {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(e.Target), dest); err != nil {
+			log.Errorf("create symlink failed. path:%s, err:%v", dest, err)
+		}
+	}
+	// children first, so setting their time does not touch the parents again
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dest := filepath.Join(root, filepath.FromSlash(dirs[i].Path))
+		if err := ApplyFileMeta(dest, dirs[i].Meta, t.policy); err != nil {
+			log.Errorf("apply directory metadata failed. path:%s, err:%v", dest, err)
+		}
+	}
+	return nil
+}
+
+// receivePath maps the relative path of an entry into root. It refuses
+// paths leaving root and paths whose parents are not plain directories.
+func receivePath(root, rel string) (string, error) {
+	clean := path.Clean("/" + rel)[1:]
+	if clean == "" || clean != rel || strings.Contains(rel, "\\") {
+		return "", fmt.Errorf("%w: invalid entry path %q", ErrPathRejected, rel)
+	}
+
+	dir := root
+	parts := strings.Split(clean, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrPathRejected, err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%w: parent of %s is not a directory", ErrPathRejected, rel)
+		}
+	}
+	return filepath.Join(dir, parts[len(parts)-1]), nil
+}
+
+// validLinkTarget tells if the target of the symlink at rel stays in root.
+// The target is followed a part at a time and must not go through another
+// link, of the manifest or already in root, which could lead out once its
+// ".." are resolved on disk.
+func validLinkTarget(root, rel, target string, links map[string]bool) bool {
+	if target == "" || path.IsAbs(target) || strings.Contains(target, "\\") {
+		return false
+	}
+	var resolved []string
+	if dir := path.Dir(rel); dir != "." {
+		resolved = strings.Split(dir, "/")
+	}
+	parts := strings.Split(target, "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return false
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, part)
+		// the link pointed to may itself be a link, it is checked on its own
+		if i == len(parts)-1 {
+			break
+		}
+		p := strings.Join(resolved, "/")
+		if links[p] {
+			return false
+		}
+		if info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(p))); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func receiveEntry(dest string, size int64, r io.Reader) error {
+	if err := removeFile(dest); err != nil {
+		return err
+	}
+	// O_EXCL also refuses to open through a symlink created in between
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return diskError(err)
+	}
+	_, err = io.CopyN(f, r, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return diskError(err)
+}
+
+// removeFile clears what a previous transfer left at dest, directories
+// excepted.
+func removeFile(dest string) error {
+	info, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w: %s is a directory", ErrPathRejected, dest)
+	}
+	return os.Remove(dest)
+}
@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildDirManifest(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	outside := filepath.Join(filepath.Dir(root), "outside")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "a"), []byte("aaa"), 0644)
+	os.WriteFile(outside, []byte("secret"), 0644)
+	if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "sub", "b")); err != nil {
+		t.Skip("no hardlinks:", err)
+	}
+	if err := os.Symlink("../a", filepath.Join(root, "sub", "in")); err != nil {
+		t.Skip("no symlinks:", err)
+	}
+	os.Symlink(outside, filepath.Join(root, "out"))
+	os.Symlink("..", filepath.Join(root, "sub", "loop"))
+
+	for links, want := range map[LinkPolicy]string{
+		LinkSkip:     "a:file sub:dir sub/b:hardlink",
+		LinkPreserve: "a:file sub:dir sub/b:hardlink sub/in:symlink sub/loop:symlink",
+		LinkFollow:   "a:file out:file sub:dir sub/b:hardlink sub/in:hardlink",
+	} {
+		manifest, err := BuildDirManifest(root, links, DefaultMetadataPolicy())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, e := range manifest.Entries {
+			got = append(got, e.Path+":"+e.Type)
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("unexpected %s manifest %v", links, got)
+		}
+	}
+}
+
+func TestDirTransmission(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(src, "sub", "c"), []byte("cc"), 0600)
+	os.Link(filepath.Join(src, "a"), filepath.Join(src, "sub", "b"))
+	os.Symlink("../a", filepath.Join(src, "sub", "in"))
+
+	manifest, err := BuildDirManifest(src, LinkPreserve, DefaultMetadataPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	sender := CreateTransmissionWithBufio(bufio.NewReadWriter(nil, bufio.NewWriter(pw)))
+	receiver := CreateTransmissionWithBufio(bufio.NewReadWriter(bufio.NewReader(pr), nil))
+	receiver.SetFileMeta(nil, DefaultMetadataPolicy())
+	go sender.SendDir(src, manifest)
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	receiver.RecvDir(dst)
+
+	for name, want := range map[string]string{"a": "aaa", "sub/b": "aaa", "sub/c": "cc", "sub/in": "aaa"} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(data) != want {
+			t.Errorf("unexpected %s content %q, err:%v", name, data, err)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "sub", "in")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink not preserved")
+	}
+	if info, err := os.Stat(filepath.Join(dst, "sub", "c")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode not preserved")
+	}
+}
+
+func TestReceiveDirOutsideRoot(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	os.MkdirAll(root, 0755)
+	os.Symlink(base, filepath.Join(root, "link"))
+
+	for _, entries := range [][]DirEntry{
+		{{Path: "../x", Type: DirEntryFile, Size: 1}},
+		{{Path: "/x", Type: DirEntryFile, Size: 1}},
+		{{Path: "link/x", Type: DirEntryFile, Size: 1}},
+		{{Path: "link", Type: DirEntryDir}, {Path: "link/x", Type: DirEntryFile, Size: 1}},
+		{{Path: "up", Type: DirEntrySymlink, Target: "../.."}},
+		{{Path: "abs", Type: DirEntrySymlink, Target: "/etc"}},
+		{{Path: "up", Type: DirEntrySymlink, Target: "."}, {Path: "up/x", Type: DirEntryFile, Size: 1}},
+		// lexically "." but the parent of the root once a is a link
+		{{Path: "a", Type: DirEntrySymlink, Target: "."}, {Path: "x", Type: DirEntrySymlink, Target: "a/.."}},
+		{{Path: "x", Type: DirEntrySymlink, Target: "link/.."}},
+	} {
+		trans := &Transmission{policy: DefaultMetadataPolicy()}
+		err := trans.receiveDir(root, &DirManifest{Entries: entries}, strings.NewReader("x"))
+		if err == nil {
+			t.Errorf("entries %v should be refused", entries)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(base, "x")); err == nil {
+		t.Errorf("file written outside of the root")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "x")); err == nil {
+		t.Errorf("link created out of a refused manifest")
+	}
+}
+
+func TestReceiveDirLinkToLink(t *testing.T) {
+	root := t.TempDir()
+	entries := []DirEntry{
+		{Path: "a", Type: DirEntrySymlink, Target: "."},
+		{Path: "x", Type: DirEntrySymlink, Target: "a"},
+	}
+	trans := &Transmission{policy: DefaultMetadataPolicy()}
+	if err := trans.receiveDir(root, &DirManifest{Entries: entries}, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "x")); err != nil || target != "a" {
+		t.Errorf("unexpected link %q, err:%v", target, err)
+	}
+}
@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var (
+	ErrTooLarge     = errors.New("larger than the accepted size")
+	ErrNoSpace      = errors.New("not enough free space")
+	ErrPathRejected = errors.New("path rejected")
+)
+
+// CheckReceive tells if size bytes may be received at path, it fails with
+// ErrTooLarge or ErrNoSpace. An unknown free space does not refuse.
+func (c *BinaryConn) CheckReceive(path string, size int64) error {
+	return checkReceive(path, size, c.config.MaxReceiveSize)
+}
+
+// LimitReceive bounds the receive of t to the size accepted from its offer.
+func (c *BinaryConn) LimitReceive(t *Transmission, size int64) {
+	t.SetReceiveLimit(size, c.config.MaxReceiveSize)
+}
+
+// LimitStream bounds the receive of a stream to the accepted size and to the
+// free space at path, empty when it is not saved.
+func (c *BinaryConn) LimitStream(t *Transmission, path string) {
+	t.SetStreamLimit(path, c.config.MaxReceiveSize)
+}
+
+func checkReceive(path string, size, maxSize int64) error {
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%w: %d bytes over %d", ErrTooLarge, size, maxSize)
+	}
+	free, err := FreeSpace(path)
+	if err != nil {
+		log.Warnf("get free space failed. path:%s, err:%v", path, err)
+		return nil
+	}
+	if size > free {
+		return fmt.Errorf("%w: %d bytes needed, %d free", ErrNoSpace, size, free)
+	}
+	return nil
+}
+
+// CheckDestination tells if a file, or a directory when dir is set, may be
+// received at path, it fails with ErrPathRejected.
+func CheckDestination(path string, dir bool) error {
+	if path == "" {
+		return fmt.Errorf("%w: empty path", ErrPathRejected)
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPathRejected, err)
+	}
+	if info.IsDir() != dir {
+		if dir {
+			return fmt.Errorf("%w: %s is not a directory", ErrPathRejected, path)
+		}
+		return fmt.Errorf("%w: %s is a directory", ErrPathRejected, path)
+	}
+	return nil
+}
+
+// FreeSpace returns the bytes available to us on the filesystem that holds
+// path, or would hold it once created.
+func FreeSpace(path string) (int64, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return freeSpace(dir)
+}
+
+// diskError marks a write failing on a full disk with ErrNoSpace.
+func diskError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %v", ErrNoSpace, err)
+	}
+	return err
+}
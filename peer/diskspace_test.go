@@ -0,0 +1,38 @@
+package peer
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckReceive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "file")
+	free, err := FreeSpace(path)
+	if err != nil {
+		t.Skip("free space unknown:", err)
+	}
+
+	if err := checkReceive(path, 1024, 0); err != nil {
+		t.Errorf("small file refused: %v", err)
+	}
+	if err := checkReceive(path, 2048, 1024); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("unexpected error over the limit: %v", err)
+	}
+	if err := checkReceive(path, free+1, 0); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("unexpected error over the free space: %v", err)
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	dir := t.TempDir()
+	if err := CheckDestination(filepath.Join(dir, "new"), false); err != nil {
+		t.Errorf("new file refused: %v", err)
+	}
+	if err := CheckDestination(dir, false); !errors.Is(err, ErrPathRejected) {
+		t.Errorf("file over a directory accepted: %v", err)
+	}
+	if err := CheckDestination(dir, true); err != nil {
+		t.Errorf("directory refused: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package peer
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// FileMeta is the metadata sent with a file. Owner and extended attributes
+// are only filled when the sender enables them.
+type FileMeta struct {
+	// Mode holds the permission bits, setuid, setgid and sticky are never
+	// sent.
+	Mode    uint32            `json:"mode"`
+	ModTime int64             `json:"mod_time"`
+	Uid     *int              `json:"uid,omitempty"`
+	Gid     *int              `json:"gid,omitempty"`
+	Xattrs  map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// MetadataPolicy selects the metadata we send and the one we apply to
+// received files. Owner needs enough privileges on the receiver, a failure
+// to apply it is logged and ignored.
+type MetadataPolicy struct {
+	Mode    bool `json:"mode"`
+	ModTime bool `json:"mod_time"`
+	Owner   bool `json:"owner"`
+	Xattrs  bool `json:"xattrs"`
+}
+
+func DefaultMetadataPolicy() MetadataPolicy {
+	return MetadataPolicy{Mode: true, ModTime: true}
+}
+
+// ReadFileMeta reads the metadata of path that the policy allows to send.
+func ReadFileMeta(path string, policy MetadataPolicy) (*FileMeta, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return fileMeta(path, info, policy), nil
+}
+
+func fileMeta(path string, info os.FileInfo, policy MetadataPolicy) *FileMeta {
+	meta := &FileMeta{
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UnixNano(),
+	}
+	if policy.Owner {
+		if uid, gid, ok := fileOwner(info); ok {
+			meta.Uid, meta.Gid = &uid, &gid
+		}
+	}
+	if policy.Xattrs {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			log.Warnf("read extended attributes failed. path:%s, err:%v", path, err)
+		}
+		meta.Xattrs = xattrs
+	}
+	return meta
+}
+
+// ApplyFileMeta sets the metadata allowed by the policy on a received file.
+// The modification time is set last since the other changes may touch it.
+func ApplyFileMeta(path string, meta *FileMeta, policy MetadataPolicy) error {
+	if meta == nil {
+		return nil
+	}
+	if policy.Xattrs {
+		for name, value := range meta.Xattrs {
+			if !receivableXattr(name) {
+				log.Warnf("skip extended attribute outside of the user namespace. path:%s, name:%s", path, name)
+				continue
+			}
+			if err := setXattr(path, name, value); err != nil {
+				log.Warnf("set extended attribute failed. path:%s, name:%s, err:%v", path, name, err)
+			}
+		}
+	}
+	if policy.Owner && meta.Uid != nil && meta.Gid != nil {
+		if err := os.Lchown(path, *meta.Uid, *meta.Gid); err != nil {
+			log.Warnf("set owner failed. path:%s, err:%v", path, err)
+		}
+	}
+	if policy.Mode {
+		if err := os.Chmod(path, os.FileMode(meta.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if policy.ModTime && meta.ModTime != 0 {
+		mtime := time.Unix(0, meta.ModTime)
+		if err := os.Chtimes(path, time.Now(), mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receivableXattr tells if a received extended attribute may be set, the
+// security, trusted and system ones could grant a capability or an ACL.
+func receivableXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") && len(name) > len("user.")
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package peer
+
+import "os"
+
+func fileOwner(os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func fileInode(os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+func fileIdentity(os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
@@ -0,0 +1,70 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileMeta(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := ReadFileMeta(src, DefaultMetadataPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Uid != nil || meta.Xattrs != nil {
+		t.Errorf("owner and xattrs should not be sent by default")
+	}
+	if err := ApplyFileMeta(dst, meta, DefaultMetadataPolicy()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("unexpected mode %v", info.Mode())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("unexpected mtime %v", info.ModTime())
+	}
+
+	// a receiver refusing metadata keeps its own
+	meta.Mode = 0777
+	if err := ApplyFileMeta(dst, meta, MetadataPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(dst); info.Mode().Perm() != 0640 {
+		t.Errorf("mode applied against the policy")
+	}
+}
+
+func TestReceivableXattr(t *testing.T) {
+	for name, want := range map[string]bool{
+		"user.comment":         true,
+		"user.":                false,
+		"security.capability":  false,
+		"security.selinux":     false,
+		"trusted.overlay":      false,
+		"system.posix_acl":     false,
+		"com.apple.quarantine": false,
+	} {
+		if got := receivableXattr(name); got != want {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// connectionGater refuses connections from blocked contacts, and from
+// unknown peers when they are blocked by policy. The relay is always allowed.
+type connectionGater struct {
+	book    *AddressBook
+	unknown TrustLevel
+	relayId string
+}
+
+func (g *connectionGater) trust(p peer.ID) TrustLevel {
+	if c, ok := g.book.Get(p.String()); ok {
+		return c.Trust
+	}
+	if p.String() == g.relayId {
+		return TrustTrusted
+	}
+	return g.unknown
+}
+
+func (g *connectionGater) allow(p peer.ID) bool {
+	if g.trust(p) == TrustBlocked {
+		log.Infof("refuse connection from blocked peer. peer:%s", p)
+		return false
+	}
+	return true
+}
+
+func (g *connectionGater) InterceptPeerDial(p peer.ID) bool {
+	return g.allow(p)
+}
+
+func (g *connectionGater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return g.allow(p)
+}
+
+func (g *connectionGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *connectionGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return g.allow(p)
+}
+
+func (g *connectionGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,195 @@
+package peer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyBucket = []byte("transfers")
+
+const (
+	TransferSend    = "send"
+	TransferReceive = "receive"
+)
+
+// TransferRecord is a finished transfer, Path is the local file sent or
+// received and Error is empty when it succeeded.
+type TransferRecord struct {
+	ID        uint64        `json:"id"`
+	Direction string        `json:"direction"`
+	PeerId    string        `json:"peer_id"`
+	Nickname  string        `json:"nickname"`
+	Name      string        `json:"name"`
+	Dir       bool          `json:"dir"`
+	Path      string        `json:"path"`
+	Size      int64         `json:"size"`
+	Hash      string        `json:"hash"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	Relayed   bool          `json:"relayed"`
+	Error     string        `json:"error"`
+}
+
+// Speed is the average speed in bytes per second.
+func (r *TransferRecord) Speed() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Size) / r.Duration.Seconds()
+}
+
+// History is the persistent list of transfers, stored in a bolt database.
+// The database is only opened for each access so several processes can
+// share it.
+type History struct {
+	path string
+}
+
+// CreateHistory keeps the history at path, an empty path records nothing.
+func CreateHistory(path string) *History {
+	return &History{path: path}
+}
+
+// Add saves a transfer and sets its ID.
+func (h *History) Add(r *TransferRecord) error {
+	if len(h.path) == 0 {
+		return nil
+	}
+	return h.update(func(b *bolt.Bucket) error {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		r.ID = id
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(historyKey(id), data)
+	})
+}
+
+// List returns the last transfers, newest first, all of them when limit is
+// 0.
+func (h *History) List(limit int) ([]TransferRecord, error) {
+	var records []TransferRecord
+	err := h.view(func(b *bolt.Bucket) error {
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (limit == 0 || len(records) < limit); k, v = c.Prev() {
+			var r TransferRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Get returns the transfer with the given ID.
+func (h *History) Get(id uint64) (TransferRecord, bool, error) {
+	var r TransferRecord
+	found := false
+	err := h.view(func(b *bolt.Bucket) error {
+		v := b.Get(historyKey(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &r)
+	})
+	return r, found, err
+}
+
+func (h *History) update(fn func(*bolt.Bucket) error) error {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	db, err := h.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// view runs fn on the transfers, not at all when nothing was recorded yet.
+func (h *History) view(fn func(*bolt.Bucket) error) error {
+	if len(h.path) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(h.path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := h.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		if b == nil {
+			return nil
+		}
+		return fn(b)
+	})
+}
+
+func (h *History) open(readOnly bool) (*bolt.DB, error) {
+	// another process may hold the database for a moment
+	return bolt.Open(h.path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+}
+
+func historyKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// startRecord starts the record of a transfer the peer package runs on its
+// own, path is the local file.
+func (c *BinaryConn) startRecord(direction, peerId, name, path string, size int64) *TransferRecord {
+	rec := &TransferRecord{
+		Direction: direction,
+		PeerId:    peerId,
+		Name:      name,
+		Path:      path,
+		Size:      size,
+		Start:     time.Now(),
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		rec.Path = abs
+	}
+	if contact, ok := c.book.Get(peerId); ok {
+		rec.Nickname = contact.Nickname
+	}
+	return rec
+}
+
+// finishRecord saves the outcome of a transfer started with startRecord,
+// trans is nil when the transfer did not go through a Transmission.
+func (c *BinaryConn) finishRecord(rec *TransferRecord, trans *Transmission, err error) {
+	rec.Duration = time.Since(rec.Start)
+	if trans != nil {
+		rec.Hash = trans.Hash()
+		rec.Relayed = trans.Relayed()
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := c.history.Add(rec); err != nil {
+		log.Errorf("save transfer history failed. err:%v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package peer
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	h := CreateHistory(filepath.Join(t.TempDir(), "history.db"))
+	if records, err := h.List(0); err != nil || len(records) != 0 {
+		t.Fatalf("unexpected records %v, err:%v", records, err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		r := &TransferRecord{Direction: TransferSend, Name: name, Size: 1000, Duration: 2 * time.Second}
+		if err := h.Add(r); err != nil {
+			t.Fatal(err)
+		}
+		if r.ID == 0 {
+			t.Errorf("record %s has no id", name)
+		}
+	}
+
+	records, err := h.List(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Name != "c" || records[1].Name != "b" {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if records[0].Speed() != 500 {
+		t.Errorf("unexpected speed %f", records[0].Speed())
+	}
+
+	r, ok, err := h.Get(records[1].ID)
+	if err != nil || !ok || r.Name != "b" {
+		t.Errorf("unexpected record %v, found:%v, err:%v", r, ok, err)
+	}
+	if _, ok, _ := h.Get(100); ok {
+		t.Errorf("unknown record found")
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	h := CreateHistory("")
+	if err := h.Add(&TransferRecord{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := h.List(0); err != nil || len(records) != 0 {
+		t.Fatalf("unexpected records %v, err:%v", records, err)
+	}
+}
+
+func TestFinishRecord(t *testing.T) {
+	dir := t.TempDir()
+	book, err := LoadAddressBook(filepath.Join(dir, "book.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Put(Contact{ID: "alice", Nickname: "Alice"})
+	c := &BinaryConn{book: book, history: CreateHistory(filepath.Join(dir, "history.db"))}
+
+	rec := c.startRecord(TransferReceive, "alice", "a.txt", "a.txt", 10)
+	c.finishRecord(rec, nil, errors.New("refused"))
+	c.finishRecord(c.startRecord(TransferSend, "bob", "b.txt", "b.txt", 20), nil, nil)
+
+	records, err := c.history.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if r := records[1]; r.Nickname != "Alice" || r.Error != "refused" || !filepath.IsAbs(r.Path) {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r := records[0]; r.Nickname != "" || r.Error != "" || r.Size != 20 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
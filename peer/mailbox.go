@@ -0,0 +1,511 @@
+package peer
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"filippo.io/edwards25519"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// MailboxPutProtocol leaves a sealed file at the relay for an offline peer,
+// MailboxDeliverProtocol is used by the relay to hand it over later.
+const MailboxPutProtocol protocol.ID = "/mailboxPut"
+const MailboxDeliverProtocol protocol.ID = "/mailboxDeliver"
+
+const (
+	MailboxOk = 0
+	// MailboxRejected tells the relay to drop a message it can never deliver.
+	MailboxRejected = 1
+	MailboxFailed   = -1
+)
+
+const mailboxRecordSize = 64 * 1024
+
+// MailboxPut asks the relay to keep a sealed file for To. The sealed file
+// follows on the stream until it is closed for writing.
+type MailboxPut struct {
+	To string `json:"to"`
+}
+
+// MailboxDelivery announces a sealed file of Size bytes sent by the relay.
+type MailboxDelivery struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// MailboxResult answers a put or a delivery.
+type MailboxResult struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// OfflineFile describes a file received through the relay mailbox. It is
+// encrypted with the content, the relay never sees it.
+type OfflineFile struct {
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	Meta *FileMeta `json:"meta,omitempty"`
+}
+
+// sealHeader starts a sealed file. The content is encrypted with a key agreed
+// between Ephemeral and the X25519 form of the recipient ed25519 identity,
+// Signature binds the ephemeral key and the recipient to the sender identity.
+type sealHeader struct {
+	From      string `json:"from"`
+	Ephemeral []byte `json:"ephemeral"`
+	Signature []byte `json:"signature"`
+}
+
+// SetOfflineFileHandler sets where files left at the relay while we were
+// offline are saved. The handler returns the path to write, or an empty
+// string to refuse the file.
+func (c *BinaryConn) SetOfflineFileHandler(onOfflineFile func(peerId string, file *OfflineFile) string) {
+	c.onOfflineFile = onOfflineFile
+}
+
+// SendOffline seals the file at path for target and leaves it at the relay,
+// which delivers it when target next connects. Only target can open it.
+func (c *BinaryConn) SendOffline(target, path string) (err error) {
+	if c.relayInfo == nil {
+		if c.relayErr != nil {
+			return fmt.Errorf("offline delivery needs a relay: %w", c.relayErr)
+		}
+		return fmt.Errorf("offline delivery needs a relay")
+	}
+	info, err := parseTarget(target)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("open file failed. err:%v", err)
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rec := c.startRecord(TransferSend, info.ID.String(), filepath.Base(path), path, stat.Size())
+	rec.Relayed = true
+	defer func() { c.finishRecord(rec, nil, err) }()
+
+	s, err := c.localNode.NewStream(c.ctx, c.relayInfo.ID, MailboxPutProtocol)
+	if err != nil {
+		log.Errorf("open mailbox stream failed. err:%v", err)
+		return err
+	}
+	stream, err := c.trackStream(s)
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	defer stream.Close()
+
+	w := bufio.NewWriter(stream)
+	if err := json.NewEncoder(w).Encode(&MailboxPut{To: info.ID.String()}); err != nil {
+		stream.Reset()
+		return err
+	}
+	priv := c.localNode.Peerstore().PrivKey(c.localNode.ID())
+	file := &OfflineFile{
+		Name: filepath.Base(path),
+		Size: stat.Size(),
+		Meta: fileMeta(path, stat, c.config.Metadata),
+	}
+	if err := sealFile(w, priv, info.ID, file, f); err != nil {
+		log.Errorf("seal file failed. err:%v", err)
+		stream.Reset()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		stream.Reset()
+		return err
+	}
+	stream.CloseWrite()
+
+	result := &MailboxResult{}
+	if err := json.NewDecoder(stream).Decode(result); err != nil {
+		return err
+	}
+	if result.Code != MailboxOk {
+		return fmt.Errorf("relay refused the file: %s", result.Msg)
+	}
+	log.Infof("file left at the relay. peer:%s, path:%s", info.ID, path)
+	return nil
+}
+
+func (c *BinaryConn) onMailboxStream(stream network.Stream) {
+	if stream.Conn().RemotePeer().String() != c.config.RelayId {
+		log.Infof("refuse mailbox stream from a peer that is not our relay. peer:%s", stream.Conn().RemotePeer())
+		stream.Reset()
+		return
+	}
+	s, err := c.trackStream(stream)
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	defer s.Close()
+
+	decoder := json.NewDecoder(s)
+	delivery := &MailboxDelivery{}
+	if err := decoder.Decode(delivery); err != nil {
+		log.Errorf("read mailbox delivery failed. err:%v", err)
+		s.Reset()
+		return
+	}
+
+	code, err := c.receiveOffline(io.LimitReader(io.MultiReader(decoder.Buffered(), s), delivery.Size))
+	result := &MailboxResult{Code: code}
+	if err != nil {
+		log.Errorf("receive offline file failed. id:%s, err:%v", delivery.ID, err)
+		result.Msg = err.Error()
+	}
+	if err := json.NewEncoder(s).Encode(result); err != nil {
+		log.Errorf("write mailbox result failed. err:%v", err)
+	}
+}
+
+func (c *BinaryConn) receiveOffline(r io.Reader) (code int, err error) {
+	priv := c.localNode.Peerstore().PrivKey(c.localNode.ID())
+	from, file, body, err := openSealed(r, priv, c.localNode.ID())
+	if err != nil {
+		return MailboxRejected, err
+	}
+	if !c.confirmPeer(from) || !c.TransferAllowed(from.String()) {
+		return MailboxRejected, fmt.Errorf("files from %s are not allowed", from)
+	}
+	if c.onOfflineFile == nil {
+		return MailboxFailed, fmt.Errorf("no handler for offline files")
+	}
+	file.Name = filepath.Base(file.Name)
+	if file.Name == "." || file.Name == ".." || file.Name == string(filepath.Separator) {
+		return MailboxRejected, fmt.Errorf("%w: invalid file name %q", ErrPathRejected, file.Name)
+	}
+	path := c.onOfflineFile(from.String(), file)
+	if len(path) == 0 {
+		return MailboxRejected, fmt.Errorf("file refused")
+	}
+	rec := c.startRecord(TransferReceive, from.String(), file.Name, path, file.Size)
+	rec.Relayed = true
+	defer func() { c.finishRecord(rec, nil, err) }()
+	if err := c.CheckReceive(path, file.Size); err != nil {
+		// the relay keeps the file for later when only the disk is full
+		if errors.Is(err, ErrNoSpace) {
+			return MailboxFailed, err
+		}
+		return MailboxRejected, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return MailboxFailed, err
+	}
+	// a byte more than announced is enough to refuse
+	n, err := io.Copy(f, io.LimitReader(body, file.Size+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > file.Size {
+		err = fmt.Errorf("%w: more than the %d bytes announced", ErrTooLarge, file.Size)
+	} else if err == nil && n != file.Size {
+		err = fmt.Errorf("got %d bytes, want %d", n, file.Size)
+	}
+	if err != nil {
+		os.Remove(path)
+		if errors.Is(err, ErrTooLarge) {
+			return MailboxRejected, err
+		}
+		return MailboxFailed, err
+	}
+	if err := ApplyFileMeta(path, file.Meta, c.config.Metadata); err != nil {
+		log.Errorf("apply file metadata failed. path:%s, err:%v", path, err)
+	}
+	log.Infof("receive offline file. peer:%s, path:%s", from, path)
+	return MailboxOk, nil
+}
+
+// sealFile encrypts file and its content read from r for the recipient to.
+// The output is a signed header record, then encrypted records of at most
+// mailboxRecordSize bytes, the first holding the file description.
+func sealFile(w io.Writer, priv crypto.PrivKey, to peer.ID, file *OfflineFile, r io.Reader) error {
+	recipient, err := x25519Public(to)
+	if err != nil {
+		return err
+	}
+	from, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	ephemeralPriv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeralPriv); err != nil {
+		return err
+	}
+	ephemeral, err := curve25519.X25519(ephemeralPriv, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(ephemeralPriv, recipient)
+	if err != nil {
+		return err
+	}
+	signature, err := priv.Sign(sealSigned(ephemeral, to))
+	if err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(&sealHeader{From: from.String(), Ephemeral: ephemeral, Signature: signature})
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(w, header); err != nil {
+		return err
+	}
+
+	sealer, err := createSealCipher(shared, ephemeral, recipient)
+	if err != nil {
+		return err
+	}
+	description, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := sealer.seal(w, description, false); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, mailboxRecordSize)
+	for {
+		n, err := io.ReadFull(r, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sealer.seal(w, buffer[:n], true)
+		}
+		if err != nil {
+			return err
+		}
+		if err := sealer.seal(w, buffer, false); err != nil {
+			return err
+		}
+	}
+}
+
+// openSealed checks the sender signature of a sealed file and returns the
+// sender, the file description and a reader of the content. The reader fails
+// if the content was cut short or altered.
+func openSealed(r io.Reader, priv crypto.PrivKey, self peer.ID) (peer.ID, *OfflineFile, io.Reader, error) {
+	data, err := readRecord(r, 4096)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	header := &sealHeader{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return "", nil, nil, fmt.Errorf("invalid sealed header: %w", err)
+	}
+
+	from, err := peer.Decode(header.From)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid sender: %w", err)
+	}
+	pub, err := from.ExtractPublicKey()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid sender: %w", err)
+	}
+	if ok, err := pub.Verify(sealSigned(header.Ephemeral, self), header.Signature); err != nil || !ok {
+		return "", nil, nil, fmt.Errorf("bad signature from %s", from)
+	}
+
+	scalar, err := x25519Private(priv)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	shared, err := curve25519.X25519(scalar, header.Ephemeral)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	recipient, err := x25519Public(self)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sealer, err := createSealCipher(shared, header.Ephemeral, recipient)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	body := &openReader{r: r, sealer: sealer}
+	if err := body.next(); err != nil {
+		return "", nil, nil, err
+	}
+	file := &OfflineFile{}
+	if err := json.Unmarshal(body.buffer, file); err != nil || body.last {
+		return "", nil, nil, fmt.Errorf("invalid sealed file description")
+	}
+	body.buffer = nil
+	return from, file, body, nil
+}
+
+func sealSigned(ephemeral []byte, to peer.ID) []byte {
+	return append(append([]byte("p2faster mailbox "), ephemeral...), to...)
+}
+
+// x25519Public converts the ed25519 key inside a peer ID to its X25519 form.
+func x25519Public(id peer.ID) ([]byte, error) {
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := pub.(*crypto.Ed25519PublicKey); !ok {
+		return nil, fmt.Errorf("offline delivery needs an ed25519 peer id")
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return nil, err
+	}
+	point, err := new(edwards25519.Point).SetBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return point.BytesMontgomery(), nil
+}
+
+// x25519Private derives the X25519 scalar of an ed25519 private key.
+func x25519Private(priv crypto.PrivKey) ([]byte, error) {
+	if _, ok := priv.(*crypto.Ed25519PrivateKey); !ok {
+		return nil, fmt.Errorf("offline delivery needs an ed25519 identity")
+	}
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha512.Sum512(raw[:32])
+	return sum[:32], nil
+}
+
+type sealCipher struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func createSealCipher(shared, ephemeral, recipient []byte) (*sealCipher, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("p2faster mailbox")), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealCipher{aead: aead}, nil
+}
+
+// seal writes one encrypted record. Records are numbered so they can't be
+// reordered, and the flag byte marks the last one so truncation is detected.
+func (s *sealCipher) seal(w io.Writer, data []byte, last bool) error {
+	flag := []byte{0}
+	if last {
+		flag[0] = 1
+	}
+	record := s.aead.Seal(flag, s.nonce(), data, flag)
+	s.counter++
+	return writeRecord(w, record)
+}
+
+func (s *sealCipher) open(record []byte) ([]byte, bool, error) {
+	if len(record) == 0 {
+		return nil, false, fmt.Errorf("empty sealed record")
+	}
+	data, err := s.aead.Open(nil, s.nonce(), record[1:], record[:1])
+	if err != nil {
+		return nil, false, fmt.Errorf("sealed record %d altered", s.counter)
+	}
+	s.counter++
+	return data, record[0] == 1, nil
+}
+
+func (s *sealCipher) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], s.counter)
+	return nonce
+}
+
+type openReader struct {
+	r      io.Reader
+	sealer *sealCipher
+	buffer []byte
+	last   bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buffer) == 0 {
+		if o.last {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buffer)
+	o.buffer = o.buffer[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	record, err := readRecord(o.r, 1+mailboxRecordSize+chacha20poly1305.Overhead)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	o.buffer, o.last, err = o.sealer.open(record)
+	return err
+}
+
+func writeRecord(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readRecord(r io.Reader, max int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(max) {
+		return nil, fmt.Errorf("sealed record too large: %d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
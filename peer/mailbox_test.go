@@ -0,0 +1,61 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSealFile(t *testing.T) {
+	alicePriv, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	bobPriv, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	evePriv, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	alice, _ := peer.IDFromPrivateKey(alicePriv)
+	bob, _ := peer.IDFromPrivateKey(bobPriv)
+	eve, _ := peer.IDFromPrivateKey(evePriv)
+
+	data := make([]byte, 3*mailboxRecordSize+100)
+	rand.Read(data)
+	sealed := &bytes.Buffer{}
+	if err := sealFile(sealed, alicePriv, bob, &OfflineFile{Name: "a.bin", Size: int64(len(data))}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Bytes(), data[:64]) || bytes.Contains(sealed.Bytes(), []byte("a.bin")) {
+		t.Errorf("sealed file leaks the plaintext")
+	}
+
+	from, file, body, err := openSealed(bytes.NewReader(sealed.Bytes()), bobPriv, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != alice || file.Name != "a.bin" || !bytes.Equal(content, data) {
+		t.Errorf("opened file differs. from:%s, name:%s", from, file.Name)
+	}
+
+	if _, _, _, err := openSealed(bytes.NewReader(sealed.Bytes()), evePriv, eve); err == nil {
+		t.Errorf("other peers should not open the file")
+	}
+
+	truncated := sealed.Bytes()[:sealed.Len()-200]
+	if _, _, body, err := openSealed(bytes.NewReader(truncated), bobPriv, bob); err == nil {
+		if _, err := io.ReadAll(body); err == nil {
+			t.Errorf("truncated file should fail to read")
+		}
+	}
+
+	altered := append([]byte{}, sealed.Bytes()...)
+	altered[len(altered)-mailboxRecordSize] ^= 1
+	if _, _, body, err := openSealed(bytes.NewReader(altered), bobPriv, bob); err == nil {
+		if _, err := io.ReadAll(body); err == nil {
+			t.Errorf("altered file should fail to read")
+		}
+	}
+}
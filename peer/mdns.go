@@ -0,0 +1,155 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+const MdnsServiceName = "_p2faster._udp"
+const NameProtocol protocol.ID = "/nameStream"
+
+// LanPeer is a p2faster peer found on the local network.
+type LanPeer struct {
+	ID   string
+	Name string
+	info peer.AddrInfo
+}
+
+// lanDiscovery finds p2faster peers with mDNS, dials them directly and asks
+// them for their display name.
+type lanDiscovery struct {
+	host     host.Host
+	name     string
+	service  mdns.Service
+	lock     sync.RWMutex
+	peers    map[peer.ID]*LanPeer
+	onChange func([]LanPeer)
+}
+
+func createLanDiscovery(h host.Host, name string, onChange func([]LanPeer)) *lanDiscovery {
+	d := &lanDiscovery{
+		host:     h,
+		name:     name,
+		peers:    make(map[peer.ID]*LanPeer),
+		onChange: onChange,
+	}
+	h.SetStreamHandler(NameProtocol, d.onNameStream)
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				d.remove(conn.RemotePeer())
+			}
+		},
+	})
+	d.service = mdns.NewMdnsService(h, MdnsServiceName, d)
+	return d
+}
+
+func (d *lanDiscovery) Start() error {
+	return d.service.Start()
+}
+
+func (d *lanDiscovery) Close() error {
+	return d.service.Close()
+}
+
+// HandlePeerFound implements mdns.Notifee.
+func (d *lanDiscovery) HandlePeerFound(info peer.AddrInfo) {
+	if info.ID == d.host.ID() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.host.Connect(ctx, info); err != nil {
+		log.Debugf("dial lan peer failed. peer:%s, err:%v", info.ID, err)
+		return
+	}
+
+	name, err := d.askName(ctx, info.ID)
+	if err != nil {
+		log.Debugf("ask lan peer name failed. peer:%s, err:%v", info.ID, err)
+		return
+	}
+
+	log.Infof("found lan peer. peer:%s, name:%s", info.ID, name)
+	d.lock.Lock()
+	d.peers[info.ID] = &LanPeer{ID: info.ID.String(), Name: name, info: info}
+	d.lock.Unlock()
+	d.notify()
+}
+
+func (d *lanDiscovery) Peers() []LanPeer {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	peers := make([]LanPeer, 0, len(d.peers))
+	for _, p := range d.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+func (d *lanDiscovery) lookup(id peer.ID) (peer.AddrInfo, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	p, ok := d.peers[id]
+	if !ok {
+		return peer.AddrInfo{}, false
+	}
+	return p.info, true
+}
+
+func (d *lanDiscovery) remove(id peer.ID) {
+	d.lock.Lock()
+	_, ok := d.peers[id]
+	delete(d.peers, id)
+	d.lock.Unlock()
+
+	if ok {
+		log.Infof("lan peer gone. peer:%s", id)
+		d.notify()
+	}
+}
+
+func (d *lanDiscovery) notify() {
+	if d.onChange != nil {
+		d.onChange(d.Peers())
+	}
+}
+
+func (d *lanDiscovery) askName(ctx context.Context, id peer.ID) (string, error) {
+	s, err := d.host.NewStream(ctx, id, NameProtocol)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+
+	name, err := bufio.NewReader(s).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(name), nil
+}
+
+func (d *lanDiscovery) onNameStream(s network.Stream) {
+	defer s.Close()
+	if _, err := s.Write([]byte(d.name + "\n")); err != nil {
+		log.Errorf("write name failed. err:%v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst lets a transfer move a whole Transmission buffer at once even
+// under a very low limit.
+const minBurst = 64 * 1024
+
+// Rates are in bytes per second, 0 means unlimited. Upload and Download are
+// shared by every transfer, the Transfer ones cap each transfer on its own.
+type Rates struct {
+	Upload           int64 `json:"upload"`
+	Download         int64 `json:"download"`
+	TransferUpload   int64 `json:"transfer_upload"`
+	TransferDownload int64 `json:"transfer_download"`
+}
+
+// RateSchedule replaces the rates between From and To, given as local
+// "15:04" times. A window ending before it starts runs past midnight, so
+// {"from": "19:00", "to": "07:00"} with no rates is unlimited overnight.
+type RateSchedule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rates
+}
+
+// RateLimits are the rates used outside of every schedule window, the first
+// window matching the current time wins.
+type RateLimits struct {
+	Rates
+	Schedule []RateSchedule `json:"schedule"`
+}
+
+// RateLimiter holds the token buckets shared by all transfers. Its limits
+// can be changed while transfers run.
+type RateLimiter struct {
+	lock     sync.Mutex
+	limits   RateLimits
+	current  Rates
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func CreateRateLimiter(limits RateLimits) (*RateLimiter, error) {
+	l := &RateLimiter{
+		upload:   rate.NewLimiter(rate.Inf, minBurst),
+		download: rate.NewLimiter(rate.Inf, minBurst),
+	}
+	if err := l.SetLimits(limits); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLimits replaces the limits, transfers in flight follow them at once.
+func (l *RateLimiter) SetLimits(limits RateLimits) error {
+	for _, s := range limits.Schedule {
+		if _, err := time.Parse("15:04", s.From); err != nil {
+			return fmt.Errorf("invalid schedule start %q: %w", s.From, err)
+		}
+		if _, err := time.Parse("15:04", s.To); err != nil {
+			return fmt.Errorf("invalid schedule end %q: %w", s.To, err)
+		}
+	}
+
+	l.lock.Lock()
+	l.limits = limits
+	l.lock.Unlock()
+	l.apply(time.Now())
+	return nil
+}
+
+func (l *RateLimiter) Limits() RateLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+// Current returns the rates in force now, after the schedule.
+func (l *RateLimiter) Current() Rates {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.current
+}
+
+// run follows the schedule until ctx is done.
+func (l *RateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.apply(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *RateLimiter) apply(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rates := l.limits.Rates
+	for _, s := range l.limits.Schedule {
+		if s.active(now) {
+			rates = s.Rates
+			break
+		}
+	}
+	if rates != l.current {
+		log.Infof("apply rate limits. upload:%d, download:%d, transfer upload:%d, transfer download:%d",
+			rates.Upload, rates.Download, rates.TransferUpload, rates.TransferDownload)
+	}
+	l.current = rates
+	setRate(l.upload, rates.Upload)
+	setRate(l.download, rates.Download)
+}
+
+// Transfer returns the limiter of a single transfer, bounded by both its own
+// rates and the shared ones.
+func (l *RateLimiter) Transfer() *TransferLimiter {
+	return &TransferLimiter{
+		shared:   l,
+		upload:   rate.NewLimiter(rate.Inf, minBurst),
+		download: rate.NewLimiter(rate.Inf, minBurst),
+	}
+}
+
+func (s *RateSchedule) active(now time.Time) bool {
+	from, _ := time.Parse("15:04", s.From)
+	to, _ := time.Parse("15:04", s.To)
+	minute := now.Hour()*60 + now.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// TransferLimiter paces one transfer, a nil TransferLimiter does nothing.
+type TransferLimiter struct {
+	shared   *RateLimiter
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+// WaitUpload blocks until n bytes may be sent.
+func (t *TransferLimiter) WaitUpload(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	current := t.shared.Current()
+	setRate(t.upload, current.TransferUpload)
+	return waitN(ctx, n, t.upload, t.shared.upload)
+}
+
+// WaitDownload blocks until n more received bytes may be consumed.
+func (t *TransferLimiter) WaitDownload(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	current := t.shared.Current()
+	setRate(t.download, current.TransferDownload)
+	return waitN(ctx, n, t.download, t.shared.download)
+}
+
+func waitN(ctx context.Context, n int, limiters ...*rate.Limiter) error {
+	for n > 0 {
+		chunk := n
+		if chunk > minBurst {
+			chunk = minBurst
+		}
+		for _, limiter := range limiters {
+			if err := limiter.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func setRate(limiter *rate.Limiter, bytesPerSecond int64) {
+	limit := rate.Inf
+	if bytesPerSecond > 0 {
+		limit = rate.Limit(bytesPerSecond)
+	}
+	if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+	}
+}
@@ -0,0 +1,76 @@
+package peer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateSchedule(t *testing.T) {
+	night := RateSchedule{From: "19:00", To: "07:00"}
+	lunch := RateSchedule{From: "12:00", To: "13:30"}
+	for clock, want := range map[string][2]bool{
+		"18:59": {false, false},
+		"19:00": {true, false},
+		"23:30": {true, false},
+		"06:59": {true, false},
+		"07:00": {false, false},
+		"12:45": {false, true},
+		"13:30": {false, false},
+	} {
+		now, _ := time.Parse("15:04", clock)
+		if night.active(now) != want[0] || lunch.active(now) != want[1] {
+			t.Errorf("unexpected windows at %s", clock)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if _, err := CreateRateLimiter(RateLimits{Schedule: []RateSchedule{{From: "7pm", To: "07:00"}}}); err == nil {
+		t.Errorf("invalid schedule should be refused")
+	}
+
+	l, err := CreateRateLimiter(RateLimits{
+		Rates:    Rates{Upload: 1 << 20, TransferUpload: 64 * 1024},
+		Schedule: []RateSchedule{{From: "19:00", To: "07:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evening, _ := time.Parse("15:04", "20:00")
+	l.apply(evening)
+	if l.Current() != (Rates{}) {
+		t.Errorf("limits should be off in the evening, got %+v", l.Current())
+	}
+	noon, _ := time.Parse("15:04", "12:00")
+	l.apply(noon)
+	if l.Current().Upload != 1<<20 {
+		t.Errorf("limits should apply at noon, got %+v", l.Current())
+	}
+
+	// the burst goes at once, the next 32KiB take half a second at 64KiB/s,
+	// reserved at a fixed time so a loaded machine does not change the delay
+	transfer := l.Transfer()
+	setRate(transfer.upload, l.Current().TransferUpload)
+	now := time.Now()
+	if delay := transfer.upload.ReserveN(now, minBurst).DelayFrom(now); delay != 0 {
+		t.Errorf("burst should not wait, got %v", delay)
+	}
+	if delay := transfer.upload.ReserveN(now, 32*1024).DelayFrom(now); delay != 500*time.Millisecond {
+		t.Errorf("unexpected pacing %v", delay)
+	}
+
+	// a slow machine only waits longer
+	start := time.Now()
+	if err := l.Transfer().WaitUpload(context.Background(), minBurst+32*1024); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("upload not paced, took %v", elapsed)
+	}
+
+	var off *TransferLimiter
+	if err := off.WaitDownload(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil limiter should not wait")
+	}
+}
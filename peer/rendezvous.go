@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RendezvousProtocol registers peers under a namespace at the relay and
+// lists the members of a namespace.
+const RendezvousProtocol protocol.ID = "/rendezvous"
+
+const (
+	RendezvousRegister   = "register"
+	RendezvousUnregister = "unregister"
+	RendezvousDiscover   = "discover"
+)
+
+// RendezvousTTL is how long a registration lasts, it is refreshed at half
+// of it while registered.
+const RendezvousTTL = time.Hour
+
+// RendezvousRequest is sent on a rendezvous stream, TTL is in seconds and
+// Addrs are the addresses of the registering peer.
+type RendezvousRequest struct {
+	Type      string   `json:"type"`
+	Namespace string   `json:"namespace"`
+	TTL       int64    `json:"ttl"`
+	Addrs     []string `json:"addrs"`
+}
+
+// RendezvousResponse answers a rendezvous request. TTL is the registration
+// lifetime granted by the relay, Peers the members found by a discover.
+type RendezvousResponse struct {
+	Code  int             `json:"code"`
+	Msg   string          `json:"msg"`
+	TTL   int64           `json:"ttl"`
+	Peers []NamespacePeer `json:"peers"`
+}
+
+// NamespacePeer is a member of a namespace. Addrs include its circuit
+// address through the relay.
+type NamespacePeer struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+// Target returns the address to pass to Connect, the first one reachable
+// through the relay when there is one.
+func (p *NamespacePeer) Target() string {
+	for _, addr := range p.Addrs {
+		if a, err := ma.NewMultiaddr(addr); err == nil {
+			if _, relayed := splitCircuitAddrs([]ma.Multiaddr{a}); len(relayed) > 0 {
+				return addr
+			}
+		}
+	}
+	return p.ID
+}
+
+// Register announces us under namespace at the relay and keeps the
+// registration alive until Unregister or Close.
+func (c *BinaryConn) Register(namespace string) error {
+	ttl, err := c.register(namespace)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.lock.Lock()
+	if old, ok := c.namespaces[namespace]; ok {
+		old()
+	}
+	c.namespaces[namespace] = cancel
+	c.lock.Unlock()
+
+	log.Infof("register in namespace. namespace:%s, ttl:%v", namespace, ttl)
+	go func(ttl time.Duration) {
+		for {
+			if ttl < 2*time.Minute {
+				ttl = 2 * time.Minute
+			}
+			select {
+			case <-time.After(ttl / 2):
+			case <-ctx.Done():
+				return
+			}
+			var err error
+			if ttl, err = c.register(namespace); err != nil {
+				log.Errorf("refresh rendezvous registration failed, retry later. namespace:%s, err:%v", namespace, err)
+				ttl = 0
+			}
+		}
+	}(ttl)
+	return nil
+}
+
+// Unregister stops announcing us under namespace.
+func (c *BinaryConn) Unregister(namespace string) error {
+	c.lock.Lock()
+	if cancel, ok := c.namespaces[namespace]; ok {
+		cancel()
+		delete(c.namespaces, namespace)
+	}
+	c.lock.Unlock()
+
+	_, err := c.rendezvous(&RendezvousRequest{Type: RendezvousUnregister, Namespace: namespace})
+	return err
+}
+
+// NamespacePeers lists the other members of namespace currently online.
+func (c *BinaryConn) NamespacePeers(namespace string) ([]NamespacePeer, error) {
+	resp, err := c.rendezvous(&RendezvousRequest{Type: RendezvousDiscover, Namespace: namespace})
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]NamespacePeer, 0, len(resp.Peers))
+	for _, p := range resp.Peers {
+		if p.ID != c.localNode.ID().String() {
+			peers = append(peers, p)
+		}
+	}
+	return peers, nil
+}
+
+func (c *BinaryConn) register(namespace string) (time.Duration, error) {
+	resp, err := c.rendezvous(&RendezvousRequest{
+		Type:      RendezvousRegister,
+		Namespace: namespace,
+		TTL:       int64(RendezvousTTL / time.Second),
+		Addrs:     c.Addrs(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+func (c *BinaryConn) rendezvous(req *RendezvousRequest) (*RendezvousResponse, error) {
+	if c.relayInfo == nil {
+		if c.relayErr != nil {
+			return nil, fmt.Errorf("namespaces need a relay: %w", c.relayErr)
+		}
+		return nil, fmt.Errorf("namespaces need a relay")
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
+	stream, err := c.localNode.NewStream(ctx, c.relayInfo.ID, RendezvousProtocol)
+	if err != nil {
+		log.Errorf("open rendezvous stream failed. err:%v", err)
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := json.NewEncoder(stream).Encode(req); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	resp := &RendezvousResponse{}
+	if err := json.NewDecoder(stream).Decode(resp); err != nil {
+		return nil, err
+	}
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("relay refused %s in %s: %s", req.Type, req.Namespace, resp.Msg)
+	}
+	return resp, nil
+}
@@ -0,0 +1,65 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+// sasWords holds 64 short, easy to tell apart words, each one encodes six
+// bits of the short authentication string.
+var sasWords = [64]string{
+	"apple", "arrow", "badge", "basket", "beach", "bell", "bird", "boat",
+	"bread", "brick", "cable", "camel", "candle", "castle", "cherry", "cloud",
+	"coffee", "comet", "crown", "daisy", "dragon", "drum", "eagle", "engine",
+	"feather", "flag", "forest", "frog", "garden", "ghost", "guitar", "hammer",
+	"honey", "island", "jacket", "jungle", "kettle", "ladder", "lemon", "lion",
+	"magnet", "maple", "mirror", "monkey", "needle", "ocean", "orange", "panda",
+	"pepper", "piano", "pirate", "planet", "rabbit", "river", "rocket", "saddle",
+	"shadow", "spider", "tiger", "tomato", "tunnel", "violin", "wallet", "zebra",
+}
+
+// 36 bits, a man in the middle has no nonce to grind once they are
+// committed to, see NonceCommitment
+const sasWordCount = 6
+
+// NonceCommitment is what the initiator of a session sends before its nonce,
+// so the other side has to pick its own nonce without knowing it.
+func NonceCommitment(nonce []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("p2faster sas commitment"))
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// ShortAuthString derives the words both ends of a session display so the
+// users can compare them out of band. It depends on both peer IDs and on the
+// nonces each side picked for this session, and is the same on both sides.
+func ShortAuthString(localId, remoteId string, localNonce, remoteNonce []byte) string {
+	firstId, firstNonce, secondId, secondNonce := localId, localNonce, remoteId, remoteNonce
+	if remoteId < localId {
+		firstId, firstNonce, secondId, secondNonce = remoteId, remoteNonce, localId, localNonce
+	}
+
+	h := sha256.New()
+	h.Write([]byte("p2faster sas"))
+	for _, part := range [][]byte{[]byte(firstId), firstNonce, []byte(secondId), secondNonce} {
+		h.Write([]byte{byte(len(part) >> 8), byte(len(part))})
+		h.Write(part)
+	}
+	sum := h.Sum(nil)
+
+	words := make([]string, 0, sasWordCount)
+	var bits, acc uint
+	for _, b := range sum {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 6 && len(words) < sasWordCount {
+			bits -= 6
+			words = append(words, sasWords[(acc>>bits)&63])
+		}
+		if len(words) == sasWordCount {
+			break
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,37 @@
+package peer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestShortAuthString(t *testing.T) {
+	alice := ShortAuthString("alice", "bob", []byte("nonce-a"), []byte("nonce-b"))
+	bob := ShortAuthString("bob", "alice", []byte("nonce-b"), []byte("nonce-a"))
+	if alice != bob {
+		t.Fatalf("both sides should agree. alice:%s, bob:%s", alice, bob)
+	}
+	if len(strings.Fields(alice)) != sasWordCount {
+		t.Errorf("unexpected word count in %q", alice)
+	}
+
+	other := ShortAuthString("alice", "mallory", []byte("nonce-a"), []byte("nonce-b"))
+	if other == alice {
+		t.Errorf("different peers should give a different string")
+	}
+	swapped := ShortAuthString("alice", "bob", []byte("nonce-b"), []byte("nonce-a"))
+	if swapped == alice {
+		t.Errorf("swapped nonces should give a different string")
+	}
+}
+
+func TestNonceCommitment(t *testing.T) {
+	commit := NonceCommitment([]byte("nonce-a"))
+	if !bytes.Equal(commit, NonceCommitment([]byte("nonce-a"))) {
+		t.Errorf("commitment should not change")
+	}
+	if bytes.Equal(commit, NonceCommitment([]byte("nonce-b"))) || bytes.Equal(commit, []byte("nonce-a")) {
+		t.Errorf("commitment should depend on the nonce and hide it")
+	}
+}
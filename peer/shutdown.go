@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// CloseTimeout is how long Close waits for transfers in flight.
+const CloseTimeout = 30 * time.Second
+
+var errClosing = fmt.Errorf("connection is closing")
+
+// transferStream is a file transfer stream that Close waits for, it counts
+// as finished once closed or reset.
+type transferStream struct {
+	network.Stream
+	conn *BinaryConn
+	once sync.Once
+}
+
+func (s *transferStream) Close() error {
+	err := s.Stream.Close()
+	s.done()
+	return err
+}
+
+func (s *transferStream) Reset() error {
+	err := s.Stream.Reset()
+	s.done()
+	return err
+}
+
+func (s *transferStream) done() {
+	s.once.Do(func() {
+		s.conn.lock.Lock()
+		delete(s.conn.streams, s)
+		s.conn.lock.Unlock()
+		s.conn.transfers.Done()
+	})
+}
+
+// beginTransfer counts a transfer in flight, it fails once Close started.
+// Every successful call must be matched by transfers.Done.
+func (c *BinaryConn) beginTransfer() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closing {
+		return errClosing
+	}
+	c.transfers.Add(1)
+	return nil
+}
+
+// trackStream wraps a transfer stream so Close waits for it, or resets it
+// when the wait times out.
+func (c *BinaryConn) trackStream(s network.Stream) (network.Stream, error) {
+	if err := c.beginTransfer(); err != nil {
+		return nil, err
+	}
+	tracked := &transferStream{Stream: s, conn: c}
+	c.lock.Lock()
+	c.streams[tracked] = struct{}{}
+	c.lock.Unlock()
+	return tracked, nil
+}
+
+func (c *BinaryConn) isClosing() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closing
+}
+
+// Close stops accepting chat sessions and transfers, ends the chat session
+// so the peer knows we are leaving, waits up to CloseTimeout for transfers in
+// flight and then closes the host. Transfers still running are reset.
+func (c *BinaryConn) Close() error {
+	c.lock.Lock()
+	if c.closing {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.lock.Unlock()
+	log.Infof("close connection, wait for transfers in flight.")
+
+	if c.localNode == nil {
+		c.cancel()
+		return nil
+	}
+	c.localNode.RemoveStreamHandler(ChatProtocol)
+	c.localNode.RemoveStreamHandler(FileSendProtocol)
+	c.localNode.RemoveStreamHandler(MailboxDeliverProtocol)
+	c.swarm.Close()
+	c.folders.Close()
+	if c.lan != nil {
+		c.lan.Close()
+	}
+	if c.chatStream != nil {
+		c.chatStream.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.transfers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(CloseTimeout):
+		c.lock.Lock()
+		streams := make([]*transferStream, 0, len(c.streams))
+		for s := range c.streams {
+			streams = append(streams, s)
+		}
+		c.lock.Unlock()
+		log.Warnf("transfers still running after %v, reset them. streams:%d", CloseTimeout, len(streams))
+		for _, s := range streams {
+			s.Reset()
+		}
+		// swarm downloads stop with the context
+		c.cancel()
+		<-done
+	}
+	c.cancel()
+
+	if c.routing != nil {
+		c.routing.Close()
+	}
+	return c.localNode.Close()
+}
@@ -0,0 +1,51 @@
+package peer
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileExtents finds the data extents of f with SEEK_DATA and SEEK_HOLE, a
+// filesystem without them reports the whole file as data.
+func fileExtents(f *os.File, size int64) ([]Extent, error) {
+	extents := []Extent{}
+	var offset int64
+	for offset < size {
+		start, err := f.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// only a hole is left
+			break
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return []Extent{{Offset: offset, Length: size - offset}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		extents = append(extents, Extent{Offset: start, Length: end - start})
+		offset = end
+	}
+	return extents, nil
+}
+
+// preallocate reserves the blocks of an extent, filesystems without
+// fallocate get the blocks as they are written.
+func preallocate(f *os.File, offset, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(f.Fd()), 0, offset, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	return err
+}
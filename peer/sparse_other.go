@@ -0,0 +1,16 @@
+//go:build !linux
+
+package peer
+
+import "os"
+
+func fileExtents(f *os.File, size int64) ([]Extent, error) {
+	if size == 0 {
+		return []Extent{}, nil
+	}
+	return []Extent{{Offset: 0, Length: size}}, nil
+}
+
+func preallocate(*os.File, int64, int64) error {
+	return nil
+}
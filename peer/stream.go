@@ -0,0 +1,173 @@
+package peer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frames of a stream of unknown length, the end frame is followed by the
+// sha256 of the data so a stream cut short is never taken for a complete one
+const (
+	streamFrameData = 'D'
+	streamFrameEnd  = 'E'
+	streamMaxFrame  = 64 * 1024
+)
+
+// SendStream sends the data read from r until EOF, the length does not have
+// to be known in advance.
+func (t *Transmission) SendStream(r io.Reader) error {
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+
+	if err := t.sendFrames(r); err != nil {
+		log.Errorf("send stream failed. err:%v", err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Transmission) sendFrames(r io.Reader) error {
+	hash := sha256.New()
+	w := bufio.NewWriterSize(transmissionWriter{t}, streamMaxFrame+binary.MaxVarintLen64+1)
+	buf := make([]byte, streamMaxFrame)
+	var sent int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			frame := binary.AppendUvarint([]byte{streamFrameData}, uint64(n))
+			if _, err := w.Write(append(frame, buf[:n]...)); err != nil {
+				return err
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	t.sum = hash.Sum(nil)
+	if _, err := w.Write(append([]byte{streamFrameEnd}, t.sum...)); err != nil {
+		return err
+	}
+	log.Infof("send stream done. size:%d", sent)
+	t.streamSize = sent
+	return w.Flush()
+}
+
+// SetStreamLimit bounds a stream, whose size is unknown, to maxSize when set
+// and to the free space at path when the stream is saved there.
+func (t *Transmission) SetStreamLimit(path string, maxSize int64) {
+	t.bound = &receiveBound{maxSize: maxSize, path: path}
+}
+
+// streamLimit returns the most a stream may write, -1 for no limit, and the
+// error beyond it.
+func (t *Transmission) streamLimit() (int64, error) {
+	if t.bound == nil {
+		return -1, nil
+	}
+	limit, limitErr := int64(-1), ErrTooLarge
+	if t.bound.maxSize > 0 {
+		limit = t.bound.maxSize
+	}
+	if t.bound.path == "" {
+		return limit, limitErr
+	}
+	free, err := FreeSpace(t.bound.path)
+	if err != nil {
+		log.Warnf("get free space failed. path:%s, err:%v", t.bound.path, err)
+	} else if limit < 0 || free < limit {
+		limit, limitErr = free, ErrNoSpace
+	}
+	return limit, limitErr
+}
+
+// RecvStream writes the data of a stream to w as it arrives, it fails when
+// the stream ends without its end frame or the hash does not match, after
+// w got the data.
+func (t *Transmission) RecvStream(w io.Writer) error {
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+
+	if err := t.recvFrames(w); err != nil {
+		log.Errorf("receive stream failed. err:%v", err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Transmission) recvFrames(w io.Writer) error {
+	limit, limitErr := t.streamLimit()
+	r := bufio.NewReader(transmissionReader{t})
+	hash := sha256.New()
+	var received int64
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return fmt.Errorf("stream ended without its end frame: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case streamFrameData:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if length > streamMaxFrame {
+				return fmt.Errorf("invalid frame of %d bytes", length)
+			}
+			if limit >= 0 && received+int64(length) > limit {
+				return fmt.Errorf("%w: stream of more than %d bytes", limitErr, limit)
+			}
+			if _, err := io.CopyN(hash, io.TeeReader(r, diskErrorWriter{w}), int64(length)); err != nil {
+				return err
+			}
+			received += int64(length)
+		case streamFrameEnd:
+			if err := t.checkHash(r, hash); err != nil {
+				return err
+			}
+			log.Infof("receive stream done. size:%d", received)
+			t.streamSize = received
+			return nil
+		default:
+			return fmt.Errorf("unknown stream frame %q", op)
+		}
+	}
+}
+
+// StreamSize returns the length of the data of a stream once sent or
+// received.
+func (t *Transmission) StreamSize() int64 {
+	return t.streamSize
+}
+
+// diskErrorWriter reports a full disk as ErrNoSpace.
+type diskErrorWriter struct {
+	w io.Writer
+}
+
+func (d diskErrorWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	return n, diskError(err)
+}
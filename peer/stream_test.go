@@ -0,0 +1,70 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	data := make([]byte, 200*1024+7)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	pr, pw := io.Pipe()
+	sender := CreateTransmissionWithBufio(bufio.NewReadWriter(nil, bufio.NewWriter(pw)))
+	receiver := CreateTransmissionWithBufio(bufio.NewReadWriter(bufio.NewReader(pr), nil))
+	errs := make(chan error, 1)
+	go func() {
+		// the sender does not know the length, reads come in small pieces
+		errs <- sender.SendStream(io.LimitReader(bufio.NewReaderSize(bytes.NewReader(data), 1000), int64(len(data))))
+	}()
+
+	got := &bytes.Buffer{}
+	if err := receiver.RecvStream(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("received stream differs")
+	}
+	sum := sha256.Sum256(data)
+	if receiver.Hash() != hex.EncodeToString(sum[:]) || sender.Hash() != receiver.Hash() {
+		t.Errorf("unexpected hashes %s %s", sender.Hash(), receiver.Hash())
+	}
+}
+
+func TestStreamCutShort(t *testing.T) {
+	for name, c := range map[string]struct {
+		stream string
+		err    error
+	}{
+		"no end frame": {stream: "D\x04data", err: io.ErrUnexpectedEOF},
+		"bad hash":     {stream: "D\x04dataE" + string(make([]byte, 32)), err: ErrHashMismatch},
+	} {
+		rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader([]byte(c.stream))), nil)
+		err := CreateTransmissionWithBufio(rw).RecvStream(io.Discard)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestStreamTooLarge(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader([]byte("D\x04dataD\x04data"))), nil)
+	trans := CreateTransmissionWithBufio(rw)
+	trans.SetStreamLimit("", 6)
+	got := &bytes.Buffer{}
+	if err := trans.RecvStream(got); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if got.String() != "data" {
+		t.Errorf("wrote %q beyond the limit", got.String())
+	}
+}
@@ -0,0 +1,497 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const SwarmHaveProtocol protocol.ID = "/swarmHave"
+const SwarmChunkProtocol protocol.ID = "/swarmChunk"
+
+const SwarmChunkSize = 1024 * 1024
+
+// a remote manifest with larger chunks is refused, a chunk is held in memory
+const swarmMaxChunkSize = 64 * 1024 * 1024
+
+// SwarmManifest describes a file shared in the swarm: the hash of the whole
+// content and the hash of every fixed size chunk.
+type SwarmManifest struct {
+	Hash      string   `json:"hash"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+}
+
+type swarmRequest struct {
+	Hash  string `json:"hash"`
+	Index int    `json:"index"`
+}
+
+type sharedFile struct {
+	path     string
+	manifest *SwarmManifest
+}
+
+// Swarm serves shared files chunk by chunk and downloads a file from all
+// peers that hold the same content hash.
+type Swarm struct {
+	host   host.Host
+	store  *ChunkStore
+	lock   sync.RWMutex
+	shared map[string]*sharedFile
+}
+
+func CreateSwarm(h host.Host) *Swarm {
+	return CreateSwarmWithStore(h, nil)
+}
+
+// CreateSwarmWithStore creates a swarm that downloads only the chunks
+// missing from the store, and records the chunks it shares or downloads.
+func CreateSwarmWithStore(h host.Host, store *ChunkStore) *Swarm {
+	s := &Swarm{
+		host:   h,
+		store:  store,
+		shared: make(map[string]*sharedFile),
+	}
+	h.SetStreamHandler(SwarmHaveProtocol, s.onHaveStream)
+	h.SetStreamHandler(SwarmChunkProtocol, s.onChunkStream)
+	return s
+}
+
+// Close stops serving shared files.
+func (s *Swarm) Close() {
+	s.host.RemoveStreamHandler(SwarmHaveProtocol)
+	s.host.RemoveStreamHandler(SwarmChunkProtocol)
+}
+
+// Share hashes the file at path and serves it to other peers by its content hash.
+func (s *Swarm) Share(path string) (*SwarmManifest, error) {
+	var manifest *SwarmManifest
+	var err error
+	if s.store != nil {
+		if path, err = filepath.Abs(path); err != nil {
+			return nil, err
+		}
+		manifest, err = s.store.Manifest(path, SwarmChunkSize)
+		if err == nil {
+			s.saveStore()
+		}
+	} else {
+		manifest, err = BuildSwarmManifest(path, SwarmChunkSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.shared[manifest.Hash] = &sharedFile{path: path, manifest: manifest}
+	s.lock.Unlock()
+
+	log.Infof("share file in swarm. path:%s, hash:%s, chunks:%d", path, manifest.Hash, len(manifest.Chunks))
+	return manifest, nil
+}
+
+// Holders asks the given peers, or every connected peer when peers is empty,
+// whether they hold hash. It returns the agreed manifest and the peers that
+// serve it.
+func (s *Swarm) Holders(ctx context.Context, hash string, peers []peer.ID) (*SwarmManifest, []peer.ID) {
+	if len(peers) == 0 {
+		peers = s.host.Network().Peers()
+	}
+
+	type answer struct {
+		id       peer.ID
+		manifest *SwarmManifest
+	}
+	answers := make(chan answer, len(peers))
+	for _, p := range peers {
+		go func(p peer.ID) {
+			manifest, err := s.askHave(ctx, p, hash)
+			if err != nil {
+				log.Debugf("ask peer for swarm file failed. peer:%s, err:%v", p, err)
+			}
+			answers <- answer{id: p, manifest: manifest}
+		}(p)
+	}
+
+	// peers may disagree on the chunk layout, keep the one most of them serve
+	var reference *SwarmManifest
+	votes := make(map[string][]peer.ID)
+	manifests := make(map[string]*SwarmManifest)
+	for range peers {
+		a := <-answers
+		if a.manifest == nil || a.manifest.Hash != hash {
+			continue
+		}
+		key := a.manifest.layoutKey()
+		votes[key] = append(votes[key], a.id)
+		manifests[key] = a.manifest
+		if reference == nil || len(votes[key]) > len(votes[reference.layoutKey()]) {
+			reference = a.manifest
+		}
+	}
+	if reference == nil {
+		return nil, nil
+	}
+	return reference, votes[reference.layoutKey()]
+}
+
+// Download fetches the file identified by hash into path, spreading the chunks
+// over every peer that holds it. Each chunk is verified before it is written,
+// a peer serving a bad chunk is dropped and the chunk is requested elsewhere.
+// The chunks found in the store are not requested, which also resumes an
+// interrupted download into the same path.
+func (s *Swarm) Download(ctx context.Context, hash, path string, peers []peer.ID) error {
+	manifest, holders := s.Holders(ctx, hash, peers)
+	if len(holders) == 0 {
+		return fmt.Errorf("no peer holds %s", hash)
+	}
+	log.Infof("start swarm download. hash:%s, chunks:%d, peers:%d", hash, len(manifest.Chunks), len(holders))
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// the data already there may be chunks of an interrupted download
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		log.Errorf("create file failed. err:%v", err)
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(manifest.Size); err != nil {
+		log.Errorf("truncate file failed. err:%v", err)
+		return err
+	}
+	if s.store != nil {
+		defer s.saveStore()
+	}
+
+	var missing []int
+	for i := range manifest.Chunks {
+		if !s.localChunk(f, path, manifest, i) {
+			missing = append(missing, i)
+		}
+	}
+	log.Infof("swarm chunks found locally. hash:%s, local:%d, missing:%d", hash, len(manifest.Chunks)-len(missing), len(missing))
+
+	left := int64(len(missing))
+	if left > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		pending := make(chan int, len(missing))
+		for _, i := range missing {
+			pending <- i
+		}
+
+		var wg sync.WaitGroup
+		for _, p := range holders {
+			wg.Add(1)
+			go func(p peer.ID) {
+				defer wg.Done()
+				for {
+					var index int
+					select {
+					case index = <-pending:
+					case <-ctx.Done():
+						return
+					}
+
+					data, err := s.fetchChunk(ctx, p, manifest, index)
+					if err == nil {
+						_, err = f.WriteAt(data, manifest.offset(index))
+					}
+					if err != nil {
+						log.Errorf("fetch chunk failed, drop peer. peer:%s, index:%d, err:%v", p, index, err)
+						pending <- index
+						return
+					}
+					s.storeChunk(path, manifest, index)
+
+					if atomic.AddInt64(&left, -1) == 0 {
+						cancel()
+					}
+				}
+			}(p)
+		}
+		wg.Wait()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if left > 0 {
+		return fmt.Errorf("swarm download incomplete, %d chunks missing", left)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != hash {
+		return fmt.Errorf("swarm download hash mismatch")
+	}
+
+	log.Infof("swarm download done. hash:%s, path:%s", hash, path)
+	return nil
+}
+
+// localChunk writes a chunk found in the store into the file, it reports
+// whether the chunk is in place.
+func (s *Swarm) localChunk(f *os.File, path string, manifest *SwarmManifest, index int) bool {
+	if s.store == nil {
+		return false
+	}
+	ref, data, ok := s.store.Lookup(manifest.Chunks[index], manifest.chunkLen(index))
+	if !ok {
+		return false
+	}
+	if ref.Path != path || ref.Offset != manifest.offset(index) {
+		if _, err := f.WriteAt(data, manifest.offset(index)); err != nil {
+			log.Errorf("write local chunk failed. index:%d, err:%v", index, err)
+			return false
+		}
+	}
+	s.storeChunk(path, manifest, index)
+	return true
+}
+
+func (s *Swarm) storeChunk(path string, manifest *SwarmManifest, index int) {
+	if s.store != nil {
+		s.store.addChunk(manifest.Chunks[index], ChunkRef{Path: path, Offset: manifest.offset(index), Length: manifest.chunkLen(index)})
+	}
+}
+
+// StoreFile records the chunks of a file received outside the swarm, so a
+// later swarm download reads them locally.
+func (s *Swarm) StoreFile(path string) {
+	if s.store == nil {
+		return
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	if _, err := s.store.Manifest(path, SwarmChunkSize); err != nil {
+		log.Errorf("hash received file failed. path:%s, err:%v", path, err)
+		return
+	}
+	s.saveStore()
+}
+
+func (s *Swarm) saveStore() {
+	if err := s.store.Save(); err != nil {
+		log.Errorf("save chunk store failed. err:%v", err)
+	}
+}
+
+func (s *Swarm) askHave(ctx context.Context, p peer.ID, hash string) (*SwarmManifest, error) {
+	stream, err := s.host.NewStream(network.WithUseTransient(ctx, "swarmHave"), p, SwarmHaveProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := json.NewEncoder(stream).Encode(&swarmRequest{Hash: hash}); err != nil {
+		return nil, err
+	}
+
+	manifest := &SwarmManifest{}
+	if err := json.NewDecoder(stream).Decode(manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Hash) == 0 {
+		return nil, nil
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, fmt.Errorf("invalid swarm manifest from %s: %w", p, err)
+	}
+	return manifest, nil
+}
+
+func (s *Swarm) fetchChunk(ctx context.Context, p peer.ID, manifest *SwarmManifest, index int) ([]byte, error) {
+	stream, err := s.host.NewStream(network.WithUseTransient(ctx, "swarmChunk"), p, SwarmChunkProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Minute))
+
+	if err := json.NewEncoder(stream).Encode(&swarmRequest{Hash: manifest.Hash, Index: index}); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, manifest.chunkLen(index))
+	if _, err := io.ReadFull(stream, data); err != nil {
+		return nil, err
+	}
+	if !manifest.verifyChunk(index, data) {
+		return nil, fmt.Errorf("chunk %d hash mismatch", index)
+	}
+	return data, nil
+}
+
+func (s *Swarm) onHaveStream(stream network.Stream) {
+	defer stream.Close()
+
+	req := &swarmRequest{}
+	if err := json.NewDecoder(stream).Decode(req); err != nil {
+		log.Errorf("read swarm request failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+
+	s.lock.RLock()
+	shared := s.shared[req.Hash]
+	s.lock.RUnlock()
+
+	manifest := &SwarmManifest{}
+	if shared != nil {
+		manifest = shared.manifest
+	}
+	if err := json.NewEncoder(stream).Encode(manifest); err != nil {
+		log.Errorf("write swarm manifest failed. err:%v", err)
+	}
+}
+
+func (s *Swarm) onChunkStream(stream network.Stream) {
+	defer stream.Close()
+
+	req := &swarmRequest{}
+	if err := json.NewDecoder(stream).Decode(req); err != nil {
+		log.Errorf("read swarm request failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+
+	s.lock.RLock()
+	shared := s.shared[req.Hash]
+	s.lock.RUnlock()
+
+	if shared == nil || req.Index < 0 || req.Index >= len(shared.manifest.Chunks) {
+		log.Errorf("swarm chunk not found. hash:%s, index:%d", req.Hash, req.Index)
+		stream.Reset()
+		return
+	}
+
+	f, err := os.Open(shared.path)
+	if err != nil {
+		log.Errorf("open file failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+	defer f.Close()
+
+	manifest := shared.manifest
+	chunk := io.NewSectionReader(f, manifest.offset(req.Index), manifest.chunkLen(req.Index))
+	if _, err := io.Copy(stream, chunk); err != nil {
+		log.Errorf("write swarm chunk failed. err:%v", err)
+		stream.Reset()
+	}
+}
+
+// BuildSwarmManifest hashes the file at path in chunks of chunkSize bytes.
+func BuildSwarmManifest(path string, chunkSize int64) (*SwarmManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := &SwarmManifest{ChunkSize: chunkSize}
+	total := sha256.New()
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, buffer)
+		if n > 0 {
+			total.Write(buffer[:n])
+			sum := sha256.Sum256(buffer[:n])
+			manifest.Chunks = append(manifest.Chunks, hex.EncodeToString(sum[:]))
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	manifest.Hash = hex.EncodeToString(total.Sum(nil))
+	return manifest, nil
+}
+
+// validate checks a manifest received from a peer before its layout is used.
+func (m *SwarmManifest) validate() error {
+	if !validSha256(m.Hash) {
+		return fmt.Errorf("invalid hash %q", m.Hash)
+	}
+	if m.ChunkSize <= 0 || m.ChunkSize > swarmMaxChunkSize {
+		return fmt.Errorf("invalid chunk size %d", m.ChunkSize)
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("invalid size %d", m.Size)
+	}
+	chunks := m.Size / m.ChunkSize
+	if m.Size%m.ChunkSize != 0 {
+		chunks++
+	}
+	if int64(len(m.Chunks)) != chunks {
+		return fmt.Errorf("%d chunks for %d bytes in chunks of %d", len(m.Chunks), m.Size, m.ChunkSize)
+	}
+	for i, c := range m.Chunks {
+		if !validSha256(c) {
+			return fmt.Errorf("invalid hash %q of chunk %d", c, i)
+		}
+	}
+	return nil
+}
+
+func validSha256(s string) bool {
+	sum, err := hex.DecodeString(s)
+	return err == nil && len(sum) == sha256.Size
+}
+
+func (m *SwarmManifest) offset(index int) int64 {
+	return int64(index) * m.ChunkSize
+}
+
+func (m *SwarmManifest) chunkLen(index int) int64 {
+	if rest := m.Size - m.offset(index); rest < m.ChunkSize {
+		return rest
+	}
+	return m.ChunkSize
+}
+
+func (m *SwarmManifest) verifyChunk(index int, data []byte) bool {
+	sum := sha256.Sum256(data)
+	return int64(len(data)) == m.chunkLen(index) && hex.EncodeToString(sum[:]) == m.Chunks[index]
+}
+
+func (m *SwarmManifest) layoutKey() string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%d/%d", m.Size, m.ChunkSize)
+	for _, c := range m.Chunks {
+		sum.Write([]byte(c))
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
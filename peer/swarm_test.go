@@ -0,0 +1,68 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwarmManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swarm")
+	data := bytes.Repeat([]byte("p2faster"), 1000)
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := BuildSwarmManifest(path, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	if manifest.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected hash %s", manifest.Hash)
+	}
+	if manifest.Size != 8000 || len(manifest.Chunks) != 3 {
+		t.Fatalf("unexpected layout. size:%d, chunks:%d", manifest.Size, len(manifest.Chunks))
+	}
+	if manifest.chunkLen(2) != 2000 {
+		t.Errorf("unexpected last chunk length %d", manifest.chunkLen(2))
+	}
+	if !manifest.verifyChunk(1, data[3000:6000]) {
+		t.Errorf("chunk 1 should verify")
+	}
+	if manifest.verifyChunk(1, data[0:3000]) && !bytes.Equal(data[0:3000], data[3000:6000]) {
+		t.Errorf("chunk 0 data should not verify as chunk 1")
+	}
+}
+
+func TestSwarmManifestValidate(t *testing.T) {
+	hash := hex.EncodeToString(make([]byte, sha256.Size))
+	valid := SwarmManifest{Hash: hash, Size: 5, ChunkSize: 3, Chunks: []string{hash, hash}}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&SwarmManifest{Hash: hash, ChunkSize: 3}).validate(); err != nil {
+		t.Errorf("empty file refused: %v", err)
+	}
+
+	for name, change := range map[string]func(m *SwarmManifest){
+		"no chunk size":   func(m *SwarmManifest) { m.ChunkSize = 0 },
+		"huge chunk size": func(m *SwarmManifest) { m.ChunkSize = 1 << 40 },
+		"negative size":   func(m *SwarmManifest) { m.Size = -1 },
+		"missing chunk":   func(m *SwarmManifest) { m.Chunks = m.Chunks[:1] },
+		"extra chunk":     func(m *SwarmManifest) { m.Chunks = append(m.Chunks, hash) },
+		"bad chunk hash":  func(m *SwarmManifest) { m.Chunks = []string{hash, "zz"} },
+		"bad hash":        func(m *SwarmManifest) { m.Hash = "abc" },
+	} {
+		m := valid
+		m.Chunks = append([]string(nil), valid.Chunks...)
+		change(&m)
+		if err := m.validate(); err == nil {
+			t.Errorf("%s: manifest accepted", name)
+		}
+	}
+}
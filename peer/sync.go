@@ -0,0 +1,687 @@
+package peer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// SyncIndexProtocol exchanges the file lists of a synced folder, each side
+// then pulls what it is missing with SyncGetProtocol.
+const SyncIndexProtocol protocol.ID = "/syncIndex"
+const SyncGetProtocol protocol.ID = "/syncGet"
+
+const (
+	// local changes are announced once the folder is quiet for syncDebounce
+	syncDebounce = 2 * time.Second
+	// syncInterval catches the changes the watcher missed
+	syncInterval = 10 * time.Minute
+)
+
+// SyncMode is the direction changes flow in, both peers of a folder must use
+// SyncBoth or one SyncSend and the other SyncReceive.
+type SyncMode string
+
+const (
+	SyncBoth    SyncMode = "both"
+	SyncSend    SyncMode = "send"
+	SyncReceive SyncMode = "receive"
+)
+
+// SyncFolder pairs a local folder with the folder of the same ID at Peer.
+type SyncFolder struct {
+	ID   string   `json:"id"`
+	Path string   `json:"path"`
+	Peer string   `json:"peer"`
+	Mode SyncMode `json:"mode"`
+}
+
+// SyncEvent reports a change applied to a synced folder.
+type SyncEvent struct {
+	Folder string
+	Path   string
+	Type   string
+	Err    error
+}
+
+const (
+	SyncPulled   = "pulled"
+	SyncDeleted  = "deleted"
+	SyncConflict = "conflict"
+	SyncFailed   = "failed"
+)
+
+var syncIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type syncIndex struct {
+	Folder string     `json:"folder"`
+	Mode   SyncMode   `json:"mode"`
+	Files  []SyncFile `json:"files"`
+}
+
+type syncGet struct {
+	Folder string `json:"folder"`
+	Path   string `json:"path"`
+	Hash   string `json:"hash"`
+}
+
+// FolderSync keeps folders in sync with peers. It watches the folders and
+// exchanges file lists with the peer on every change, when the peer
+// connects and every syncInterval. Only regular files are synced, empty
+// directories and links are not.
+type FolderSync struct {
+	conn    *BinaryConn
+	dir     string
+	onEvent func(SyncEvent)
+	ctx     context.Context
+
+	lock    sync.Mutex
+	folders map[string]*syncFolder
+}
+
+type syncFolder struct {
+	SyncFolder
+	sync   *FolderSync
+	peer   peer.ID
+	kick   chan struct{}
+	cancel context.CancelFunc
+
+	// run serializes the scans and the changes applied, stateLock guards
+	// state
+	run       sync.Mutex
+	stateLock sync.Mutex
+	state     *syncState
+}
+
+func createFolderSync(c *BinaryConn, dir string, onEvent func(SyncEvent)) *FolderSync {
+	s := &FolderSync{
+		conn:    c,
+		dir:     dir,
+		onEvent: onEvent,
+		ctx:     c.ctx,
+		folders: make(map[string]*syncFolder),
+	}
+	c.localNode.SetStreamHandler(SyncIndexProtocol, s.onIndexStream)
+	c.localNode.SetStreamHandler(SyncGetProtocol, s.onGetStream)
+	// sync resumes whenever the peer comes back
+	c.localNode.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			for _, f := range s.folders {
+				if f.peer == conn.RemotePeer() {
+					f.trigger()
+				}
+			}
+		},
+	})
+	return s
+}
+
+// Start syncs the folders saved by Add.
+func (s *FolderSync) Start() error {
+	var folders []SyncFolder
+	if err := readJSON(s.foldersPath(), &folders); err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if err := s.start(folder); err != nil {
+			log.Errorf("start folder sync failed. folder:%s, err:%v", folder.ID, err)
+		}
+	}
+	return nil
+}
+
+// Close stops syncing, pulls in flight are waited for by BinaryConn.Close.
+func (s *FolderSync) Close() {
+	s.conn.localNode.RemoveStreamHandler(SyncIndexProtocol)
+	s.conn.localNode.RemoveStreamHandler(SyncGetProtocol)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, f := range s.folders {
+		f.cancel()
+	}
+}
+
+// Add starts syncing a folder with the folder of the same ID at the peer and
+// saves it, so it is synced again on the next start.
+func (s *FolderSync) Add(folder SyncFolder) error {
+	if folder.Mode == "" {
+		folder.Mode = SyncBoth
+	}
+	abs, err := filepath.Abs(folder.Path)
+	if err != nil {
+		return err
+	}
+	folder.Path = abs
+	if err := s.start(folder); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Remove stops syncing a folder and forgets its state, the files stay.
+func (s *FolderSync) Remove(id string) error {
+	s.lock.Lock()
+	f, ok := s.folders[id]
+	delete(s.folders, id)
+	s.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown sync folder %s", id)
+	}
+	f.cancel()
+	if err := os.Remove(s.statePath(id)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("remove sync state failed. folder:%s, err:%v", id, err)
+	}
+	return s.save()
+}
+
+// Folders returns the synced folders sorted by ID.
+func (s *FolderSync) Folders() []SyncFolder {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	folders := make([]SyncFolder, 0, len(s.folders))
+	for _, f := range s.folders {
+		folders = append(folders, f.SyncFolder)
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].ID < folders[j].ID
+	})
+	return folders
+}
+
+// SyncNow exchanges file lists with the peer of the folder without waiting
+// for a change.
+func (s *FolderSync) SyncNow(id string) error {
+	f := s.folder(id)
+	if f == nil {
+		return fmt.Errorf("unknown sync folder %s", id)
+	}
+	f.trigger()
+	return nil
+}
+
+func (s *FolderSync) start(folder SyncFolder) error {
+	if !syncIdPattern.MatchString(folder.ID) {
+		return fmt.Errorf("invalid sync folder id %q", folder.ID)
+	}
+	if folder.Mode != SyncBoth && folder.Mode != SyncSend && folder.Mode != SyncReceive {
+		return fmt.Errorf("invalid sync mode %q", folder.Mode)
+	}
+	id, err := peer.Decode(folder.Peer)
+	if err != nil {
+		return fmt.Errorf("invalid peer id %s: %w", folder.Peer, err)
+	}
+	info, err := os.Stat(folder.Path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", folder.Path)
+	}
+	state, err := loadSyncState(s.statePath(folder.ID))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	f := &syncFolder{
+		SyncFolder: folder,
+		sync:       s,
+		peer:       id,
+		kick:       make(chan struct{}, 1),
+		cancel:     cancel,
+		state:      state,
+	}
+	s.lock.Lock()
+	if _, ok := s.folders[folder.ID]; ok {
+		s.lock.Unlock()
+		cancel()
+		return fmt.Errorf("sync folder %s already exists", folder.ID)
+	}
+	s.folders[folder.ID] = f
+	s.lock.Unlock()
+
+	log.Infof("start folder sync. folder:%s, path:%s, peer:%s, mode:%s", folder.ID, folder.Path, folder.Peer, folder.Mode)
+	go f.loop(ctx)
+	return nil
+}
+
+func (s *FolderSync) save() error {
+	return writeJSON(s.foldersPath(), s.Folders())
+}
+
+func (s *FolderSync) foldersPath() string {
+	return filepath.Join(s.dir, "folders.json")
+}
+
+func (s *FolderSync) statePath(id string) string {
+	return filepath.Join(s.dir, "state", id+".json")
+}
+
+func (s *FolderSync) folder(id string) *syncFolder {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.folders[id]
+}
+
+// peerFolder returns the folder shared with the peer of the stream, if the
+// peer may send us files.
+func (s *FolderSync) peerFolder(stream network.Stream, id string) *syncFolder {
+	f := s.folder(id)
+	remote := stream.Conn().RemotePeer()
+	if f == nil || f.peer != remote || !s.conn.TransferAllowed(remote.String()) {
+		log.Infof("refuse sync stream. folder:%s, peer:%s", id, remote)
+		return nil
+	}
+	return f
+}
+
+func (s *FolderSync) event(e SyncEvent) {
+	if e.Err != nil {
+		log.Errorf("sync file failed. folder:%s, path:%s, err:%v", e.Folder, e.Path, e.Err)
+	} else {
+		log.Infof("sync file. folder:%s, path:%s, type:%s", e.Folder, e.Path, e.Type)
+	}
+	if s.onEvent != nil {
+		s.onEvent(e)
+	}
+}
+
+// onIndexStream answers the file list of the peer with ours, then applies
+// the changes of the peer.
+func (s *FolderSync) onIndexStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := &syncIndex{}
+	if err := json.NewDecoder(stream).Decode(remote); err != nil {
+		log.Errorf("read sync index failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+	f := s.peerFolder(stream, remote.Folder)
+	if f == nil {
+		stream.Reset()
+		return
+	}
+
+	local, err := f.scan()
+	if err != nil {
+		log.Errorf("scan sync folder failed. folder:%s, err:%v", f.ID, err)
+		stream.Reset()
+		return
+	}
+	if err := json.NewEncoder(stream).Encode(f.index(local)); err != nil {
+		log.Errorf("write sync index failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+	f.apply(remote)
+}
+
+// onGetStream sends a file of the folder if it still has the hash the peer
+// asks for.
+func (s *FolderSync) onGetStream(stream network.Stream) {
+	req := &syncGet{}
+	if err := json.NewDecoder(stream).Decode(req); err != nil {
+		log.Errorf("read sync request failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+	f := s.peerFolder(stream, req.Folder)
+	if f == nil || f.Mode == SyncReceive || !validSyncPath(req.Path) {
+		stream.Reset()
+		return
+	}
+
+	f.stateLock.Lock()
+	file, ok := f.state.Index[req.Path]
+	f.stateLock.Unlock()
+	if !ok || file.Hash != req.Hash || !f.unchanged(req.Path, &file) {
+		log.Infof("sync file changed since it was announced. folder:%s, path:%s", f.ID, req.Path)
+		stream.Reset()
+		return
+	}
+
+	tracked, err := s.conn.trackStream(stream)
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	trans := CreateTransmission(tracked)
+	trans.SetRateLimiter(s.conn.limiter)
+	rec := s.conn.startRecord(TransferSend, f.Peer, req.Path, f.localPath(req.Path), file.Size)
+	err = trans.SendFile(rec.Path)
+	if err != nil {
+		log.Errorf("send sync file failed. folder:%s, path:%s, err:%v", f.ID, req.Path, err)
+	}
+	s.conn.finishRecord(rec, trans, err)
+}
+
+func (f *syncFolder) trigger() {
+	select {
+	case f.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (f *syncFolder) loop(ctx context.Context) {
+	var events chan fsnotify.Event
+	var errors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("watch sync folder failed, only sync every %v. folder:%s, err:%v", syncInterval, f.ID, err)
+	} else {
+		defer watcher.Close()
+		f.watch(watcher, f.Path)
+		events, errors = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	// the first exchange runs once the debounce delay passed
+	debounce := time.NewTimer(syncDebounce)
+	defer debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			if skipSyncName(filepath.Base(e.Name)) {
+				continue
+			}
+			if e.Op&fsnotify.Create != 0 {
+				if info, err := os.Lstat(e.Name); err == nil && info.IsDir() {
+					f.watch(watcher, e.Name)
+				}
+			}
+			debounce.Reset(syncDebounce)
+		case err := <-errors:
+			log.Errorf("watch sync folder failed. folder:%s, err:%v", f.ID, err)
+		case <-debounce.C:
+			f.exchange(ctx)
+		case <-ticker.C:
+			f.exchange(ctx)
+		case <-f.kick:
+			f.exchange(ctx)
+		}
+	}
+}
+
+// watch adds the directories under root to the watcher, fsnotify does not
+// watch recursively.
+func (f *syncFolder) watch(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(p); err != nil {
+			log.Errorf("watch directory failed. path:%s, err:%v", p, err)
+		}
+		return nil
+	})
+}
+
+// exchange sends our file list to the peer, applies the changes of the list
+// it answers with and lets it pull ours.
+func (f *syncFolder) exchange(ctx context.Context) {
+	local, err := f.scan()
+	if err != nil {
+		log.Errorf("scan sync folder failed. folder:%s, err:%v", f.ID, err)
+		return
+	}
+	host := f.sync.conn.localNode
+	if host.Network().Connectedness(f.peer) != network.Connected {
+		log.Debugf("sync peer is offline. folder:%s, peer:%s", f.ID, f.peer)
+		return
+	}
+	stream, err := host.NewStream(network.WithUseTransient(ctx, "syncIndex"), f.peer, SyncIndexProtocol)
+	if err != nil {
+		log.Errorf("open sync stream failed. folder:%s, err:%v", f.ID, err)
+		return
+	}
+	defer stream.Close()
+
+	if err := json.NewEncoder(stream).Encode(f.index(local)); err != nil {
+		log.Errorf("write sync index failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+	remote := &syncIndex{}
+	if err := json.NewDecoder(stream).Decode(remote); err != nil {
+		log.Errorf("read sync index failed. err:%v", err)
+		stream.Reset()
+		return
+	}
+	f.apply(remote)
+}
+
+func (f *syncFolder) index(files map[string]SyncFile) *syncIndex {
+	index := &syncIndex{Folder: f.ID, Mode: f.Mode, Files: make([]SyncFile, 0, len(files))}
+	for _, file := range files {
+		index.Files = append(index.Files, file)
+	}
+	return index
+}
+
+// scan refreshes the index of the local files.
+func (f *syncFolder) scan() (map[string]SyncFile, error) {
+	f.run.Lock()
+	defer f.run.Unlock()
+	return f.scanLocked()
+}
+
+func (f *syncFolder) scanLocked() (map[string]SyncFile, error) {
+	f.stateLock.Lock()
+	cache := f.state.Index
+	f.stateLock.Unlock()
+	files, err := scanFolder(f.Path, cache)
+	if err != nil {
+		return nil, err
+	}
+	f.stateLock.Lock()
+	f.state.Index = files
+	f.stateLock.Unlock()
+	f.saveState()
+	return files, nil
+}
+
+func (f *syncFolder) saveState() {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	if err := writeJSON(f.sync.statePath(f.ID), f.state); err != nil {
+		log.Errorf("save sync state failed. folder:%s, err:%v", f.ID, err)
+	}
+}
+
+// apply pulls and deletes files to catch up with the file list of the peer.
+func (f *syncFolder) apply(remote *syncIndex) {
+	// a receive only peer serves no file
+	if f.Mode == SyncSend || remote.Mode == SyncReceive {
+		return
+	}
+	f.run.Lock()
+	defer f.run.Unlock()
+
+	files := make(map[string]SyncFile, len(remote.Files))
+	for _, file := range remote.Files {
+		if validSyncPath(file.Path) {
+			files[file.Path] = file
+		}
+	}
+	f.stateLock.Lock()
+	local, base := f.state.Index, f.state.Base
+	f.stateLock.Unlock()
+	actions, newBase := planSync(local, files, base, f.Mode, f.sync.conn.localNode.ID().String(), f.Peer)
+
+	for _, a := range actions {
+		l, lok := local[a.path]
+		expect := &l
+		if !lok {
+			expect = nil
+		}
+		// the file changed since the scan, the next exchange sees it
+		if !f.unchanged(a.path, expect) {
+			continue
+		}
+
+		e := SyncEvent{Folder: f.ID, Path: a.path}
+		switch a.op {
+		case syncPull:
+			e.Type, e.Err = SyncPulled, f.pull(a.path, a.file)
+		case syncDelete:
+			e.Type, e.Err = SyncDeleted, f.remove(a.path)
+		case syncKeepLocal:
+			e.Type, e.Path = SyncConflict, a.conflict
+			// the base stays until the peer has our version too, or the
+			// next exchange would take its version for the newer one
+			e.Err = f.pull(a.conflict, a.file)
+		case syncKeepRemote:
+			e.Type = SyncConflict
+			e.Err = os.Rename(f.localPath(a.path), f.localPath(a.conflict))
+			if e.Err == nil {
+				e.Err = f.pull(a.path, a.file)
+			}
+		}
+		if e.Err != nil {
+			e.Type = SyncFailed
+			f.sync.event(e)
+			continue
+		}
+		switch a.op {
+		case syncPull, syncKeepRemote:
+			newBase[a.path] = a.file.Hash
+		case syncDelete:
+			delete(newBase, a.path)
+		}
+		f.sync.event(e)
+	}
+
+	f.stateLock.Lock()
+	f.state.Base = newBase
+	f.stateLock.Unlock()
+	if _, err := f.scanLocked(); err != nil {
+		log.Errorf("scan sync folder failed. folder:%s, err:%v", f.ID, err)
+	}
+}
+
+// pull fetches the version of the peer aside and moves it in place once its
+// hash is verified.
+func (f *syncFolder) pull(rel string, file SyncFile) (err error) {
+	dest := f.localPath(rel)
+	if err := f.mkdirParents(rel); err != nil {
+		return err
+	}
+	if err := f.sync.conn.CheckReceive(dest, file.Size); err != nil {
+		return err
+	}
+	stream, err := f.sync.conn.localNode.NewStream(network.WithUseTransient(f.sync.ctx, "syncGet"), f.peer, SyncGetProtocol)
+	if err != nil {
+		return err
+	}
+	tracked, err := f.sync.conn.trackStream(stream)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	if err := json.NewEncoder(tracked).Encode(&syncGet{Folder: f.ID, Path: rel, Hash: file.Hash}); err != nil {
+		tracked.Reset()
+		return err
+	}
+
+	tmp := dest + syncTempSuffix
+	defer os.Remove(tmp)
+	trans := CreateTransmission(tracked)
+	trans.SetRateLimiter(f.sync.conn.limiter)
+	f.sync.conn.LimitReceive(trans, file.Size)
+	rec := f.sync.conn.startRecord(TransferReceive, f.Peer, rel, dest, file.Size)
+	defer func() { f.sync.conn.finishRecord(rec, trans, err) }()
+	if err := trans.RecvFile(tmp); err != nil {
+		return err
+	}
+	hash, err := hashFile(tmp)
+	if err != nil {
+		return err
+	}
+	if hash != file.Hash {
+		return ErrHashMismatch
+	}
+	if err := os.Chmod(tmp, os.FileMode(file.Mode).Perm()); err != nil {
+		log.Errorf("set file mode failed. path:%s, err:%v", tmp, err)
+	}
+	if err := os.Chtimes(tmp, file.ModTime, file.ModTime); err != nil {
+		log.Errorf("set file time failed. path:%s, err:%v", tmp, err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	f.sync.conn.StoreChunks(dest)
+	return nil
+}
+
+// mkdirParents creates the directories of rel under the folder, refusing
+// to go through a link or a file.
+func (f *syncFolder) mkdirParents(rel string) error {
+	dir := f.Path
+	parts := strings.Split(path.Dir(rel), "/")
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return diskError(err)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%w: %s is not a directory", ErrPathRejected, dir)
+		}
+	}
+	return nil
+}
+
+// remove deletes a file and the directories it leaves empty.
+func (f *syncFolder) remove(rel string) error {
+	if err := os.Remove(f.localPath(rel)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(f.localPath(dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// unchanged tells if the local file is still the scanned version, expect is
+// nil when it did not exist.
+func (f *syncFolder) unchanged(rel string, expect *SyncFile) bool {
+	info, err := os.Lstat(f.localPath(rel))
+	if expect == nil {
+		return os.IsNotExist(err)
+	}
+	return err == nil && info.Mode().IsRegular() && info.Size() == expect.Size && info.ModTime().Equal(expect.ModTime)
+}
+
+func (f *syncFolder) localPath(rel string) string {
+	return filepath.Join(f.Path, filepath.FromSlash(rel))
+}
@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanSync(t *testing.T) {
+	old := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	newer := old.Add(time.Hour)
+	for _, c := range []struct {
+		name           string
+		local, remote  *SyncFile
+		base           string
+		mode           SyncMode
+		want, wantBase string
+	}{
+		{name: "same", local: &SyncFile{Hash: "a"}, remote: &SyncFile{Hash: "a"}, want: "", wantBase: "a"},
+		{name: "remote changed", local: &SyncFile{Hash: "a"}, remote: &SyncFile{Hash: "b"}, base: "a", want: "pull", wantBase: "a"},
+		{name: "local changed", local: &SyncFile{Hash: "b"}, remote: &SyncFile{Hash: "a"}, base: "a", want: "", wantBase: "a"},
+		{name: "new remote", remote: &SyncFile{Hash: "a"}, want: "pull"},
+		{name: "new local", local: &SyncFile{Hash: "a"}, want: ""},
+		{name: "remote deleted", local: &SyncFile{Hash: "a"}, base: "a", want: "delete", wantBase: "a"},
+		{name: "local deleted", remote: &SyncFile{Hash: "a"}, base: "a", want: "", wantBase: "a"},
+		{name: "modified beats remote delete", local: &SyncFile{Hash: "b"}, base: "a", want: "", wantBase: "a"},
+		{name: "modified beats local delete", remote: &SyncFile{Hash: "b"}, base: "a", want: "pull", wantBase: "a"},
+		{name: "both deleted", base: "a", want: ""},
+		{name: "remote newer conflict", local: &SyncFile{Hash: "b", ModTime: old}, remote: &SyncFile{Hash: "c", ModTime: newer}, base: "a", want: "keep remote", wantBase: "a"},
+		{name: "local newer conflict", local: &SyncFile{Hash: "b", ModTime: newer}, remote: &SyncFile{Hash: "c", ModTime: old}, base: "a", want: "keep local", wantBase: "a"},
+		{name: "conflict without base", local: &SyncFile{Hash: "b", ModTime: old}, remote: &SyncFile{Hash: "c", ModTime: old}, want: "keep remote"},
+		{name: "mirror local change", local: &SyncFile{Hash: "b"}, remote: &SyncFile{Hash: "a"}, base: "a", mode: SyncReceive, want: "pull", wantBase: "a"},
+		{name: "mirror local delete", remote: &SyncFile{Hash: "a"}, base: "a", mode: SyncReceive, want: "pull", wantBase: "a"},
+		{name: "mirror remote delete", local: &SyncFile{Hash: "b"}, base: "a", mode: SyncReceive, want: "delete", wantBase: "a"},
+	} {
+		local, remote, base := map[string]SyncFile{}, map[string]SyncFile{}, map[string]string{}
+		if c.local != nil {
+			local["f"] = *c.local
+		}
+		if c.remote != nil {
+			remote["f"] = *c.remote
+		}
+		if c.base != "" {
+			base["f"] = c.base
+		}
+		mode := c.mode
+		if mode == "" {
+			mode = SyncBoth
+		}
+
+		actions, newBase := planSync(local, remote, base, mode, "peerA", "peerB")
+		got := ""
+		for _, a := range actions {
+			got = [...]string{"pull", "delete", "keep local", "keep remote"}[a.op]
+		}
+		if got != c.want || newBase["f"] != c.wantBase {
+			t.Errorf("%s: got %q base %q, want %q base %q", c.name, got, newBase["f"], c.want, c.wantBase)
+		}
+	}
+}
+
+func TestPlanSyncConflictName(t *testing.T) {
+	old := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	newer := old.Add(time.Hour)
+	a := map[string]SyncFile{"doc/notes.txt": {Path: "doc/notes.txt", Hash: "a", ModTime: newer}}
+	b := map[string]SyncFile{"doc/notes.txt": {Path: "doc/notes.txt", Hash: "b", ModTime: old}}
+
+	// both peers keep the newer version and name the copy of the other one
+	// the same way
+	fromA, _ := planSync(a, b, nil, SyncBoth, "12D3KooWpeerAAAAAA", "12D3KooWpeerBBBBBB")
+	fromB, _ := planSync(b, a, nil, SyncBoth, "12D3KooWpeerBBBBBB", "12D3KooWpeerAAAAAA")
+	if len(fromA) != 1 || len(fromB) != 1 {
+		t.Fatalf("unexpected actions %v %v", fromA, fromB)
+	}
+	if fromA[0].op != syncKeepLocal || fromB[0].op != syncKeepRemote {
+		t.Errorf("unexpected conflict resolution %d %d", fromA[0].op, fromB[0].op)
+	}
+	want := "doc/notes.sync-conflict-20230601-100000-BBBBBB.txt"
+	if fromA[0].conflict != want || fromB[0].conflict != want {
+		t.Errorf("unexpected conflict copies %s %s", fromA[0].conflict, fromB[0].conflict)
+	}
+}
+
+func TestScanFolder(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "a"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "b"), []byte("bb"), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "c"+syncTempSuffix), []byte("partial"), 0644)
+	os.Symlink("a", filepath.Join(root, "link"))
+
+	files, err := scanFolder(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, " ") != "a sub/b" {
+		t.Fatalf("unexpected files %v", paths)
+	}
+
+	// an unchanged file keeps its cached hash
+	cached := files["a"]
+	cached.Hash = "cached"
+	files, err = scanFolder(root, map[string]SyncFile{"a": cached})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["a"].Hash != "cached" {
+		t.Errorf("unchanged file hashed again")
+	}
+	want, _ := hashFile(filepath.Join(root, "sub", "b"))
+	if files["sub/b"].Hash != want {
+		t.Errorf("unexpected hash %s", files["sub/b"].Hash)
+	}
+}
+
+func TestValidSyncPath(t *testing.T) {
+	for p, want := range map[string]bool{
+		"a":                  true,
+		"sub/a":              true,
+		"":                   false,
+		"/etc/passwd":        false,
+		"../a":               false,
+		"sub/../../a":        false,
+		"./a":                false,
+		"a\\..\\b":           false,
+		"a" + syncTempSuffix: false,
+	} {
+		if validSyncPath(p) != want {
+			t.Errorf("validSyncPath(%q) should be %v", p, want)
+		}
+	}
+}
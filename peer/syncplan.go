@@ -0,0 +1,229 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncTempSuffix marks the files being pulled, they are never announced.
+const syncTempSuffix = ".p2faster-sync"
+
+// SyncFile is a regular file of a synced folder as announced to the peer,
+// Path is slash separated and relative to the folder.
+type SyncFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Mode    uint32    `json:"mode"`
+	Hash    string    `json:"hash"`
+}
+
+// syncState is what a folder remembers between runs: the hash both peers
+// agreed on at the last sync of each path, which tells a local change from a
+// remote one, and the hashes of the local files.
+type syncState struct {
+	Base  map[string]string   `json:"base"`
+	Index map[string]SyncFile `json:"index"`
+}
+
+const (
+	// syncPull fetches the remote version into the path
+	syncPull = iota
+	// syncDelete removes the local file the peer deleted
+	syncDelete
+	// syncKeepLocal fetches the remote version of a conflict into a copy
+	syncKeepLocal
+	// syncKeepRemote moves the local version of a conflict to a copy then
+	// pulls the remote one
+	syncKeepRemote
+)
+
+type syncAction struct {
+	op       int
+	path     string
+	file     SyncFile
+	conflict string
+}
+
+// planSync compares the local and remote files with the last agreed
+// versions. A change on one side only is applied to the other, a change on
+// both sides is a conflict: the newer version keeps the path, the other one
+// is kept beside it on both peers. A modified file wins over a deletion. In
+// SyncReceive mode the folder mirrors the remote one. It returns the actions
+// to apply and the new base, which the actions update once done.
+func planSync(local, remote map[string]SyncFile, base map[string]string, mode SyncMode, localId, remoteId string) ([]syncAction, map[string]string) {
+	paths := make(map[string]struct{})
+	for p := range local {
+		paths[p] = struct{}{}
+	}
+	for p := range remote {
+		paths[p] = struct{}{}
+	}
+
+	var actions []syncAction
+	newBase := make(map[string]string)
+	for p := range paths {
+		l, lok := local[p]
+		r, rok := remote[p]
+		b, bok := base[p]
+		if bok {
+			newBase[p] = b
+		}
+
+		switch {
+		case lok && rok:
+			switch {
+			case l.Hash == r.Hash:
+				newBase[p] = l.Hash
+			case mode == SyncReceive, bok && l.Hash == b:
+				actions = append(actions, syncAction{op: syncPull, path: p, file: r})
+			case bok && r.Hash == b:
+				// only changed here, the peer pulls it
+			case r.ModTime.After(l.ModTime) || r.ModTime.Equal(l.ModTime) && remoteId > localId:
+				actions = append(actions, syncAction{op: syncKeepRemote, path: p, file: r, conflict: conflictName(p, l.ModTime, localId)})
+			default:
+				actions = append(actions, syncAction{op: syncKeepLocal, path: p, file: r, conflict: conflictName(p, r.ModTime, remoteId)})
+			}
+		case lok:
+			if bok && (l.Hash == b || mode == SyncReceive) {
+				actions = append(actions, syncAction{op: syncDelete, path: p})
+			}
+		case rok:
+			// a file deleted here and unchanged there is deleted by the peer
+			if !bok || r.Hash != b || mode == SyncReceive {
+				actions = append(actions, syncAction{op: syncPull, path: p, file: r})
+			}
+		default:
+			delete(newBase, p)
+		}
+	}
+	return actions, newBase
+}
+
+// conflictName names the copy keeping the losing version of a conflict, it
+// only depends on that version so both peers pick the same name:
+// notes.sync-conflict-20060102-150405-abcdef.txt
+func conflictName(p string, modTime time.Time, peerId string) string {
+	ext := path.Ext(p)
+	if len(peerId) > 6 {
+		peerId = peerId[len(peerId)-6:]
+	}
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s", strings.TrimSuffix(p, ext), modTime.UTC().Format("20060102-150405"), peerId, ext)
+}
+
+// scanFolder lists the regular files under root, hashing only the files
+// whose size or modification time differ from the cached index.
+func scanFolder(root string, cache map[string]SyncFile) (map[string]SyncFile, error) {
+	files := make(map[string]SyncFile)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || skipSyncName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		file := SyncFile{Path: rel, Size: info.Size(), ModTime: info.ModTime(), Mode: uint32(info.Mode().Perm())}
+		if cached, ok := cache[rel]; ok && cached.Size == file.Size && cached.ModTime.Equal(file.ModTime) {
+			file.Hash = cached.Hash
+		} else if file.Hash, err = hashFile(p); err != nil {
+			return err
+		}
+		files[rel] = file
+		return nil
+	})
+	return files, err
+}
+
+// skipSyncName leaves out the files of transfers in progress.
+func skipSyncName(name string) bool {
+	return strings.HasSuffix(name, syncTempSuffix) || strings.HasSuffix(name, ".delta.part")
+}
+
+// validSyncPath refuses remote paths that leave the folder.
+func validSyncPath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, "\\") || path.Clean(p) != p {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." || part == "." {
+			return false
+		}
+	}
+	return !skipSyncName(path.Base(p))
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func loadSyncState(p string) (*syncState, error) {
+	state := &syncState{Base: make(map[string]string), Index: make(map[string]SyncFile)}
+	if err := readJSON(p, state); err != nil {
+		return nil, err
+	}
+	if state.Base == nil {
+		state.Base = make(map[string]string)
+	}
+	if state.Index == nil {
+		state.Index = make(map[string]SyncFile)
+	}
+	return state, nil
+}
+
+// readJSON leaves v untouched when the file does not exist.
+func readJSON(p string, v interface{}) error {
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON writes aside and renames so a crash never leaves a truncated
+// file.
+func writeJSON(p string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -4,7 +4,12 @@ package peer
 
 import (
 	"flag"
+	"os"
+	"os/signal"
 	"p2faster/peer"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -13,14 +18,48 @@ import (
 var log = logging.Logger("test")
 
 func main() {
-	dist := flag.String("d", "", "your fanal nodeID")
+	dist := flag.String("d", "", "your fanal nodeID, multiaddr or nodeID@host:port")
+	listen := flag.String("l", "", "comma separated multiaddrs to listen on")
+	noRelay := flag.Bool("norelay", false, "only use direct connections")
+	configPath := flag.String("config", filepath.Join(peer.ConfigDir(), "config.json"), "json config file")
+	psk := flag.String("psk", "", "private network pre-shared key file, overrides the config")
+	unknown := flag.String("unknown", string(peer.TrustTrusted), "trust for peers missing from the address book: trusted or blocked")
+	namespace := flag.String("ns", "", "register in this namespace at the relay and list its members")
+	upload := flag.Int64("up", -1, "upload limit in KiB/s, 0 is unlimited, overrides the config")
+	download := flag.Int64("down", -1, "download limit in KiB/s, 0 is unlimited, overrides the config")
+	offline := flag.String("offline", "", "leave this file at the relay for -d instead of connecting")
+	dhtMode := flag.String("dht", peer.DhtOff, "dht used to find peers: private, public or empty to disable")
 	flag.Parse()
 
 	logging.SetLogLevel("p2p-holepunch", "debug")
 	logging.SetLogLevel("peer", "info")
 	//*dist = "12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca"
 
-	conn := peer.CreateBinaryConn(
+	config, err := peer.LoadConfig(*configPath)
+	if err != nil {
+		log.Errorf("load config failed. err:%v", err)
+		return
+	}
+	if len(*psk) > 0 {
+		config.PrivateNetworkKeyPath = *psk
+	}
+	config.Dht = *dhtMode
+	config.UnknownPeers = peer.TrustLevel(*unknown)
+	if len(*listen) > 0 {
+		config.ListenAddrs = strings.Split(*listen, ",")
+	}
+	if *noRelay {
+		config.RelayId = ""
+	}
+	if *upload >= 0 {
+		config.RateLimits.Upload = *upload * 1024
+	}
+	if *download >= 0 {
+		config.RateLimits.Download = *download * 1024
+	}
+
+	conn := peer.CreateBinaryConnWithConfig(
+		config,
 		func(s network.Stream) {
 			chat := peer.CreateChat(s)
 			chat.Start()
@@ -29,10 +68,51 @@ func main() {
 			chat.Start()
 		}, onId)
 
-	conn.Init()
+	conn.SetOfflineFileHandler(func(peerId string, file *peer.OfflineFile) string {
+		log.Infof("receive offline file. peer:%s, name:%s, size:%d", peerId, file.Name, file.Size)
+		return file.Name
+	})
+
+	if err := conn.Init(); err != nil {
+		log.Errorf("init failed. err:%v", err)
+		return
+	}
+	log.Infof("local addresses:%v", conn.Addrs())
+	if len(*namespace) > 0 {
+		if err := conn.Register(*namespace); err != nil {
+			log.Errorf("register in namespace failed. err:%v", err)
+		} else if peers, err := conn.NamespacePeers(*namespace); err == nil {
+			for _, p := range peers {
+				log.Infof("namespace member. id:%s, target:%s", p.ID, p.Target())
+			}
+		}
+	}
+	if len(*offline) > 0 {
+		if err := conn.SendOffline(*dist, *offline); err != nil {
+			log.Errorf("send offline failed. err:%v", err)
+		}
+		return
+	}
 	conn.Connect(*dist)
 
-	select {}
+	// SIGHUP applies the rate limits of the config file again
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloaded, err := peer.LoadConfig(*configPath)
+		if err == nil {
+			err = conn.RateLimiter().SetLimits(reloaded.RateLimits)
+		}
+		if err != nil {
+			log.Errorf("reload rate limits failed. err:%v", err)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		log.Errorf("close failed. err:%v", err)
+	}
 }
 
 func onId(id string) {
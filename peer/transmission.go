@@ -2,15 +2,59 @@ package peer
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
+// Extent is a range of a file holding data, the ranges between extents are
+// holes.
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// ErrHashMismatch fails a transfer whose content differs from the hash the
+// sender computed.
+var ErrHashMismatch = errors.New("content hash mismatch")
+
+// fileLayout starts a file send, the data of its extents follows in order
+// then the sha256 of that data.
+type fileLayout struct {
+	Size    int64    `json:"size"`
+	Extents []Extent `json:"extents"`
+}
+
 type Transmission struct {
 	rw     *bufio.ReadWriter
 	stream network.Stream
+	limit  *TransferLimiter
+	meta   *FileMeta
+	policy MetadataPolicy
+	// sum is the sha256 of the content once sent or verified
+	sum []byte
+	// streamSize is the length of a stream, known once it ended
+	streamSize int64
+	// bound is the size accepted for a receive, written counts against it
+	bound   *receiveBound
+	written int64
+}
+
+type receiveBound struct {
+	size    int64
+	maxSize int64
+	// path is where a stream is saved, empty when it is not
+	path string
 }
 
 func CreateTransmission(stream network.Stream) *Transmission {
@@ -26,98 +70,233 @@ func CreateTransmissionWithBufio(rw *bufio.ReadWriter) *Transmission {
 	}
 }
 
-func (t *Transmission) RecvFile(path string) {
+// SetRateLimiter paces the transfer with the limiter, it must be called
+// before RecvFile or SendFile.
+func (t *Transmission) SetRateLimiter(l *RateLimiter) {
+	if l != nil {
+		t.limit = l.Transfer()
+	}
+}
+
+// SetFileMeta sets the metadata RecvFile applies to the file once received.
+func (t *Transmission) SetFileMeta(meta *FileMeta, policy MetadataPolicy) {
+	t.meta = meta
+	t.policy = policy
+}
+
+// SetReceiveLimit bounds a receive to the size accepted from its offer and
+// to maxSize when set, the sender announcing or writing more fails it with
+// ErrTooLarge.
+func (t *Transmission) SetReceiveLimit(size, maxSize int64) {
+	t.bound = &receiveBound{size: size, maxSize: maxSize}
+}
+
+// checkSize refuses a layout or manifest announcing more than accepted.
+func (t *Transmission) checkSize(size int64) error {
+	if t.bound == nil {
+		return nil
+	}
+	if size > t.bound.size || (t.bound.maxSize > 0 && size > t.bound.maxSize) {
+		return fmt.Errorf("%w: %d bytes announced, %d accepted", ErrTooLarge, size, t.bound.size)
+	}
+	return nil
+}
+
+// receiving counts n more bytes about to be written, it fails once they go
+// beyond the accepted size.
+func (t *Transmission) receiving(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("invalid size %d", n)
+	}
+	t.written += n
+	if t.bound == nil {
+		return nil
+	}
+	if t.written > t.bound.size || (t.bound.maxSize > 0 && t.written > t.bound.maxSize) {
+		return fmt.Errorf("%w: %d bytes written, %d accepted", ErrTooLarge, t.written, t.bound.size)
+	}
+	return nil
+}
+
+// RecvFile allocates the data extents announced by the sender before
+// writing them, so a full disk fails the transfer at once, and leaves the
+// holes in between unallocated.
+func (t *Transmission) RecvFile(path string) error {
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+	}()
+
+	decoder := json.NewDecoder(t.rw)
+	layout := &fileLayout{}
+	if err := decoder.Decode(layout); err != nil {
+		log.Errorf("read file layout failed. err:%v", err)
+		return err
+	}
+	if err := t.checkSize(layout.Size); err != nil {
+		log.Errorf("refuse file layout. err:%v", err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
+	}
+
 	f, err := os.Create(path)
 	if err != nil {
 		log.Errorf("create file failed. err:%v", err)
-		return
+		return diskError(err)
 	}
 	defer f.Close()
 
-	recvChan := make(chan []byte, 100)
-	go t.read(recvChan)
-
-	totalCount := 0
-	for buf := range recvChan {
-		count := 0
-		totalCount += len(buf)
-		log.Debugf("recv from chan:%d", totalCount)
-		for {
-			n, err := f.Write(buf[count:])
-			if err != nil {
-				log.Errorf("write data to file failed. err:%v", err)
-			}
-			count += n
-			if count >= len(buf) {
-				break
-			}
+	r := io.MultiReader(decoder.Buffered(), transmissionReader{t})
+	if err := t.receiveExtents(f, layout, r); err != nil {
+		log.Errorf("receive file failed. path:%s, err:%v", path, err)
+		if t.stream != nil {
+			t.stream.Reset()
 		}
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		log.Errorf("close file failed. err:%v", err)
+		return diskError(err)
 	}
-	if t.stream != nil {
-		t.stream.Close()
+	if err := ApplyFileMeta(path, t.meta, t.policy); err != nil {
+		log.Errorf("apply file metadata failed. path:%s, err:%v", path, err)
 	}
+	return nil
 }
 
-func (t *Transmission) SendFile(path string) {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Errorf("open file failed. err:%v", err)
-		return
+func (t *Transmission) receiveExtents(f *os.File, layout *fileLayout, r io.Reader) error {
+	var end int64
+	for _, e := range layout.Extents {
+		if e.Offset < end || e.Length < 0 || e.Offset+e.Length > layout.Size {
+			return fmt.Errorf("invalid extent %d+%d", e.Offset, e.Length)
+		}
+		end = e.Offset + e.Length
+		if err := preallocate(f, e.Offset, e.Length); err != nil {
+			return diskError(err)
+		}
 	}
-	defer file.Close()
 
-	totalCount := 0
-	buffer := make([]byte, 1024*10)
-	done := false
-	for {
-		bytesread, err := file.Read(buffer[0:])
-		if err != nil {
-			if err != io.EOF {
-				log.Errorf("read file failed. err:%v", err)
-				return
-			}
-			done = true
+	hash := sha256.New()
+	var received int64
+	for _, e := range layout.Extents {
+		if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
 		}
-
-		totalCount += bytesread
-		log.Debugf("send to stream:%d", totalCount)
-		err = t.write(buffer[:bytesread])
-		if err != nil {
-			log.Errorf("write data failed. err:%v", err)
-			done = true
+		if err := t.receiving(e.Length); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.MultiWriter(f, hash), r, e.Length); err != nil {
+			return diskError(err)
 		}
+		received += e.Length
+		log.Debugf("recv extent. offset:%d, length:%d, total:%d", e.Offset, e.Length, received)
+	}
+	if err := t.checkHash(r, hash); err != nil {
+		return err
+	}
+	// a trailing hole has no extent to write
+	return diskError(f.Truncate(layout.Size))
+}
 
-		if done {
-			break
+// checkHash reads the hash ending a send and compares it to ours.
+func (t *Transmission) checkHash(r io.Reader, h hash.Hash) error {
+	sum := make([]byte, h.Size())
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return ErrHashMismatch
+	}
+	t.sum = sum
+	return nil
+}
+
+// Hash returns the hex sha256 of the content sent or received, empty until
+// the transfer succeeded.
+func (t *Transmission) Hash() string {
+	return hex.EncodeToString(t.sum)
+}
+
+// Relayed tells if the transfer goes through a relay circuit.
+func (t *Transmission) Relayed() bool {
+	if t.stream == nil {
+		return false
+	}
+	_, err := t.stream.Conn().RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// SendFile sends the layout of the file then the data of its extents, the
+// holes of a sparse file are not sent.
+func (t *Transmission) SendFile(path string) error {
+	defer func() {
+		if t.stream != nil {
+			t.stream.Close()
 		}
+	}()
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Errorf("open file failed. err:%v", err)
+		return err
 	}
-	if t.stream != nil {
-		t.stream.Close()
+	defer file.Close()
+
+	if err := t.sendExtents(file); err != nil {
+		log.Errorf("send file failed. path:%s, err:%v", path, err)
+		if t.stream != nil {
+			t.stream.Reset()
+		}
+		return err
 	}
+	return nil
 }
 
-func (t *Transmission) read(out chan<- []byte) {
-	defer close(out)
-	done := false
-	for {
-		buf := make([]byte, 1024*10)
-		num, err := t.rw.Read(buf)
+func (t *Transmission) sendExtents(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	extents, err := fileExtents(file, info.Size())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&fileLayout{Size: info.Size(), Extents: extents})
+	if err != nil {
+		return err
+	}
+	if err := t.write(data); err != nil {
+		return err
+	}
 
-		if err != nil {
-			if err != io.EOF {
-				log.Errorf("read data failed. err:%v", err)
-				return
-			}
-			done = true
+	hash := sha256.New()
+	var sent int64
+	for _, e := range extents {
+		if _, err := file.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
 		}
-		out <- buf[0:num]
-		if done {
-			break
+		n, err := io.CopyN(io.MultiWriter(transmissionWriter{t}, hash), file, e.Length)
+		if err == io.EOF {
+			return fmt.Errorf("file shrank while sending")
+		}
+		if err != nil {
+			return err
 		}
+		sent += n
+		log.Debugf("send extent. offset:%d, length:%d, total:%d", e.Offset, e.Length, sent)
 	}
+	t.sum = hash.Sum(nil)
+	return t.write(t.sum)
 }
 
 func (t *Transmission) write(data []byte) error {
+	if err := t.limit.WaitUpload(context.Background(), len(data)); err != nil {
+		return err
+	}
 	writeCount := 0
 	for {
 		count, err := t.rw.Write(data[writeCount:])
@@ -133,3 +312,28 @@ func (t *Transmission) write(data []byte) error {
 	t.rw.Flush()
 	return nil
 }
+
+// transmissionWriter and transmissionReader pace the stream with the rate
+// limits of the transfer.
+type transmissionWriter struct {
+	t *Transmission
+}
+
+func (w transmissionWriter) Write(p []byte) (int, error) {
+	if err := w.t.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type transmissionReader struct {
+	t *Transmission
+}
+
+func (r transmissionReader) Read(p []byte) (int, error) {
+	n, err := r.t.rw.Read(p)
+	if waitErr := r.t.limit.WaitDownload(context.Background(), n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
@@ -2,6 +2,12 @@ package peer
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -34,3 +40,109 @@ func TestTransmission(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 }
+
+func TestSparseTransmission(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.img")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("boot"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(32 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	sender := CreateTransmissionWithBufio(bufio.NewReadWriter(nil, bufio.NewWriter(pw)))
+	receiver := CreateTransmissionWithBufio(bufio.NewReadWriter(bufio.NewReader(pr), nil))
+	errs := make(chan error, 1)
+	go func() { errs <- sender.SendFile(src) }()
+
+	dst := filepath.Join(dir, "copy.img")
+	if err := receiver.RecvFile(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("received file differs")
+	}
+
+	// the copy keeps holes wherever the filesystem reports them for the source
+	if allocated(t, dst) > allocated(t, src) {
+		t.Errorf("holes not kept")
+	}
+}
+
+func TestTransmissionHashMismatch(t *testing.T) {
+	stream := `{"size":4,"extents":[{"offset":0,"length":4}]}data` + strings.Repeat("x", 32)
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(stream)), nil)
+	err := CreateTransmissionWithBufio(rw).RecvFile(filepath.Join(t.TempDir(), "file"))
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestTransmissionTooLarge(t *testing.T) {
+	stream := `{"size":4,"extents":[{"offset":0,"length":4}]}data` + strings.Repeat("x", 32)
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(stream)), nil)
+	trans := CreateTransmissionWithBufio(rw)
+	// the offer said 1 byte
+	trans.SetReceiveLimit(1, 0)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := trans.RecvFile(path); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("file created")
+	}
+
+	dir := t.TempDir()
+	manifest := &DirManifest{Entries: []DirEntry{
+		{Path: "a", Type: DirEntryFile, Size: 2},
+		{Path: "b", Type: DirEntryFile, Size: -1},
+		{Path: "c", Type: DirEntryFile, Size: 2},
+	}}
+	trans = &Transmission{}
+	trans.SetReceiveLimit(3, 0)
+	if err := trans.receiveDir(dir, manifest, strings.NewReader("aacc")); err == nil {
+		t.Errorf("directory over the accepted size received")
+	}
+}
+
+func allocated(t *testing.T, path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	extents, err := fileExtents(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data int64
+	for _, e := range extents {
+		data += e.Length
+	}
+	return data
+}
@@ -0,0 +1,41 @@
+//go:build linux || darwin
+
+package peer
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = unix.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return xattrs, err
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(path, string(name), value); err != nil {
+			return xattrs, err
+		}
+		xattrs[string(name)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package peer
+
+import "fmt"
+
+func readXattrs(string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattr(string, string, []byte) error {
+	return fmt.Errorf("extended attributes are not supported")
+}
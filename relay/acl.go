@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ACLConfig limits the relay to known peers. The relay is open to everyone
+// when both lists are empty.
+type ACLConfig struct {
+	// AllowPeers is a static list of peer IDs allowed to use the relay.
+	AllowPeers []string `yaml:"allow_peers"`
+	// AllowFile holds more peer IDs, one per line with # comments. It is
+	// reloaded when it changes or on SIGHUP.
+	AllowFile string `yaml:"allow_file"`
+}
+
+const aclPollInterval = 10 * time.Second
+
+// aclFilter implements relay.ACLFilter with an allowlist of peer IDs. Both
+// ends of a circuit must be allowed.
+type aclFilter struct {
+	lock    sync.RWMutex
+	file    string
+	static  map[peer.ID]struct{}
+	dynamic map[peer.ID]struct{}
+	modTime time.Time
+}
+
+func createACL(config ACLConfig) (*aclFilter, error) {
+	a := &aclFilter{}
+	if err := a.update(config); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// update replaces the static list and the allow file, used when the config
+// is reloaded. Nothing changes when either one is invalid.
+func (a *aclFilter) update(config ACLConfig) error {
+	static := make(map[peer.ID]struct{})
+	for _, id := range config.AllowPeers {
+		p, err := peer.Decode(id)
+		if err != nil {
+			return fmt.Errorf("invalid peer id %q in allow_peers: %w", id, err)
+		}
+		static[p] = struct{}{}
+	}
+	var dynamic map[peer.ID]struct{}
+	var modTime time.Time
+	if len(config.AllowFile) > 0 {
+		var err error
+		if dynamic, modTime, err = readAllowFile(config.AllowFile); err != nil {
+			return err
+		}
+	}
+
+	a.lock.Lock()
+	a.static = static
+	a.file = config.AllowFile
+	a.dynamic = dynamic
+	a.modTime = modTime
+	a.lock.Unlock()
+	if len(config.AllowFile) > 0 {
+		log.Printf("load %d peers from allow file %s", len(dynamic), config.AllowFile)
+	}
+	return nil
+}
+
+func (a *aclFilter) enabled() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.static) > 0 || len(a.file) > 0
+}
+
+// Reload reads the allow file again, the previous list is kept on error.
+func (a *aclFilter) Reload() error {
+	a.lock.RLock()
+	file := a.file
+	a.lock.RUnlock()
+	if len(file) == 0 {
+		return nil
+	}
+
+	allowed, modTime, err := readAllowFile(file)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.dynamic = allowed
+	a.modTime = modTime
+	a.lock.Unlock()
+	log.Printf("load %d peers from allow file %s", len(allowed), file)
+	return nil
+}
+
+func readAllowFile(file string) (map[peer.ID]struct{}, time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	allowed := make(map[peer.ID]struct{})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		p, err := peer.Decode(text)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("invalid peer id at %s:%d: %w", file, line, err)
+		}
+		allowed[p] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	return allowed, info.ModTime(), nil
+}
+
+// watch reloads the allow file whenever its modification time changes.
+func (a *aclFilter) watch() {
+	for range time.Tick(aclPollInterval) {
+		a.lock.RLock()
+		file, modTime := a.file, a.modTime
+		a.lock.RUnlock()
+		if len(file) == 0 {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Printf("Failed to stat the allow file: %v", err)
+			continue
+		}
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+		if err := a.Reload(); err != nil {
+			log.Printf("Failed to reload the allow file, keep the previous list: %v", err)
+		}
+	}
+}
+
+func (a *aclFilter) allowed(p peer.ID) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if _, ok := a.static[p]; ok {
+		return true
+	}
+	_, ok := a.dynamic[p]
+	return ok
+}
+
+func (a *aclFilter) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	if !a.allowed(p) {
+		log.Printf("refuse reservation from %s at %s: not in the allowlist", p, addr)
+		return false
+	}
+	return true
+}
+
+func (a *aclFilter) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	if !a.allowed(src) {
+		log.Printf("refuse circuit from %s at %s to %s: source not in the allowlist", src, srcAddr, dest)
+		return false
+	}
+	if !a.allowed(dest) {
+		log.Printf("refuse circuit from %s at %s to %s: destination not in the allowlist", src, srcAddr, dest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestACL(t *testing.T) {
+	alice, _ := peer.Decode("12D3KooW9qaj35NgxHjtrH6uKEKKgE1iPhYjrKpTKnDh1mUeGCAh")
+	bob, _ := peer.Decode("12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca")
+
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	if err := os.WriteFile(path, []byte("# team\n\n"+bob.String()+" # bob\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := createACL(ACLConfig{AllowFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.enabled() {
+		t.Fatalf("acl with an allow file should be enabled")
+	}
+	if !acl.AllowReserve(bob, nil) || acl.AllowReserve(alice, nil) {
+		t.Errorf("only bob should reserve")
+	}
+	if acl.AllowConnect(alice, nil, bob) {
+		t.Errorf("alice is not allowed to open circuits")
+	}
+
+	os.WriteFile(path, []byte(alice.String()+"\n"+bob.String()+"\n"), 0666)
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.AllowConnect(alice, nil, bob) {
+		t.Errorf("alice should be allowed after reload")
+	}
+
+	os.WriteFile(path, []byte("not-a-peer\n"), 0666)
+	if err := acl.Reload(); err == nil {
+		t.Errorf("invalid allow file should fail to load")
+	}
+	if !acl.AllowReserve(alice, nil) {
+		t.Errorf("failed reload should keep the previous list")
+	}
+
+	// a config reload with a bad allow file keeps the static list too
+	os.WriteFile(path, []byte(alice.String()+"\n"), 0666)
+	acl.Reload()
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	os.WriteFile(bad, []byte("not-a-peer\n"), 0666)
+	if err := acl.update(ACLConfig{AllowPeers: []string{bob.String()}, AllowFile: bad}); err == nil {
+		t.Errorf("invalid allow file should fail the update")
+	}
+	if !acl.AllowReserve(alice, nil) || acl.AllowReserve(bob, nil) {
+		t.Errorf("failed update should keep the previous lists")
+	}
+
+	open, err := createACL(ACLConfig{})
+	if err != nil || open.enabled() {
+		t.Errorf("empty acl should be disabled")
+	}
+}
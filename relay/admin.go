@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+type reservationInfo struct {
+	Peer    string    `json:"peer"`
+	Addr    string    `json:"addr"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+}
+
+// the tag the relay service puts on a peer once it granted it a
+// reservation, and removes when the reservation expires
+const reservationTag = "relay-reservation"
+
+// circuitInfo is a circuit the ACL allowed. The relay may still refuse it
+// for its own limits and does not report which circuits it opened or when
+// they end, so it is dropped once the circuit duration limit passes or
+// either end disconnects.
+type circuitInfo struct {
+	Src     string    `json:"src"`
+	SrcAddr string    `json:"src_addr"`
+	Dest    string    `json:"dest"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+
+	src, dest peer.ID
+}
+
+type bans struct {
+	Peers []string `json:"peers"`
+	IPs   []string `json:"ips"`
+}
+
+// admin tracks reservations and circuits for the admin API and enforces the
+// runtime bans. It sits in front of the allowlist as the relay ACL and is
+// also the connection gater of the relay host. Reservations are only
+// recorded once the relay granted them, see trackReservations. Bans only
+// live in memory.
+type admin struct {
+	acl        *aclFilter
+	host       host.Host
+	onReserve  func(peer.ID)
+	lock       sync.Mutex
+	ttl        time.Duration
+	circuitTTL time.Duration
+	draining   bool
+
+	reservations map[peer.ID]*reservationInfo
+	circuits     []*circuitInfo
+	bannedPeers  map[peer.ID]struct{}
+	bannedIPs    map[string]struct{}
+}
+
+func createAdmin(acl *aclFilter, limits Limits) *admin {
+	return &admin{
+		acl:          acl,
+		ttl:          limits.ReservationTTL,
+		circuitTTL:   limits.Duration,
+		reservations: make(map[peer.ID]*reservationInfo),
+		bannedPeers:  make(map[peer.ID]struct{}),
+		bannedIPs:    make(map[string]struct{}),
+	}
+}
+
+// attach starts following the connections of the relay host.
+func (a *admin) attach(h host.Host) {
+	a.host = h
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			p := conn.RemotePeer()
+			if n.Connectedness(p) == network.Connected {
+				return
+			}
+			a.lock.Lock()
+			delete(a.reservations, p)
+			a.dropCircuits(func(c *circuitInfo) bool { return c.src == p || c.dest == p })
+			a.lock.Unlock()
+		},
+	})
+}
+
+func (a *admin) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	if a.isDraining() {
+		log.Printf("refuse reservation from %s at %s: shutting down", p, addr)
+		return false
+	}
+	if a.banned(p, addr) {
+		log.Printf("refuse reservation from banned %s at %s", p, addr)
+		return false
+	}
+	return !a.acl.enabled() || a.acl.AllowReserve(p, addr)
+}
+
+// reservationTracker is the connection manager of the relay host. The relay
+// service tags a peer once it granted the reservation, after its own limits,
+// which is the only place it tells which peer it accepted.
+type reservationTracker struct {
+	connmgr.ConnManager
+	admin *admin
+}
+
+// trackReservations wraps the connection manager of the relay host to
+// record the reservations the relay grants.
+func (a *admin) trackReservations(cm connmgr.ConnManager) connmgr.ConnManager {
+	return &reservationTracker{ConnManager: cm, admin: a}
+}
+
+func (t *reservationTracker) TagPeer(p peer.ID, tag string, value int) {
+	t.ConnManager.TagPeer(p, tag, value)
+	if tag == reservationTag {
+		t.admin.reserved(p)
+	}
+}
+
+func (t *reservationTracker) UntagPeer(p peer.ID, tag string) {
+	t.ConnManager.UntagPeer(p, tag)
+	if tag == reservationTag {
+		t.admin.lock.Lock()
+		delete(t.admin.reservations, p)
+		t.admin.lock.Unlock()
+	}
+}
+
+// reserved records a reservation the relay granted or renewed, and delivers
+// the files waiting for the peer.
+func (a *admin) reserved(p peer.ID) {
+	var addr string
+	if a.host != nil {
+		if conns := a.host.Network().ConnsToPeer(p); len(conns) > 0 {
+			addr = conns[0].RemoteMultiaddr().String()
+		}
+	}
+
+	now := time.Now()
+	a.lock.Lock()
+	r, ok := a.reservations[p]
+	if !ok {
+		r = &reservationInfo{Peer: p.String(), Since: now}
+		a.reservations[p] = r
+	}
+	if len(addr) > 0 {
+		r.Addr = addr
+	}
+	r.Expires = now.Add(a.ttl)
+	a.lock.Unlock()
+
+	if a.onReserve != nil {
+		go a.onReserve(p)
+	}
+}
+
+func (a *admin) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	if a.isDraining() {
+		log.Printf("refuse circuit from %s at %s to %s: shutting down", src, srcAddr, dest)
+		return false
+	}
+	if a.banned(src, srcAddr) || a.banned(dest, nil) {
+		log.Printf("refuse circuit from %s at %s to %s: banned", src, srcAddr, dest)
+		return false
+	}
+	if a.acl.enabled() && !a.acl.AllowConnect(src, srcAddr, dest) {
+		return false
+	}
+
+	now := time.Now()
+	a.lock.Lock()
+	a.circuits = append(a.circuits, &circuitInfo{
+		Src:     src.String(),
+		SrcAddr: srcAddr.String(),
+		Dest:    dest.String(),
+		Since:   now,
+		Expires: now.Add(a.circuitTTL),
+		src:     src,
+		dest:    dest,
+	})
+	a.lock.Unlock()
+	return true
+}
+
+// drain refuses every new reservation and circuit, open circuits go on.
+func (a *admin) drain() {
+	a.lock.Lock()
+	a.draining = true
+	a.lock.Unlock()
+}
+
+func (a *admin) isDraining() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.draining
+}
+
+// allowPeer applies the bans and the allowlist to a peer using the relay
+// without a reservation or circuit.
+func (a *admin) allowPeer(p peer.ID, addr ma.Multiaddr) bool {
+	if a.banned(p, addr) {
+		return false
+	}
+	return !a.acl.enabled() || a.acl.allowed(p)
+}
+
+// allowMailbox applies the bans and the allowlist to a file left for dest.
+func (a *admin) allowMailbox(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	if a.banned(src, srcAddr) || a.banned(dest, nil) {
+		return false
+	}
+	return !a.acl.enabled() || a.acl.AllowConnect(src, srcAddr, dest)
+}
+
+func (a *admin) banned(p peer.ID, addr ma.Multiaddr) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.bannedPeers[p]; ok {
+		return true
+	}
+	if addr != nil {
+		if ip, err := manet.ToIP(addr); err == nil {
+			_, ok := a.bannedIPs[ip.String()]
+			return ok
+		}
+	}
+	return false
+}
+
+func (a *admin) InterceptPeerDial(p peer.ID) bool {
+	return !a.banned(p, nil)
+}
+
+func (a *admin) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return !a.banned(p, addr)
+}
+
+func (a *admin) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return !a.banned("", addrs.RemoteMultiaddr())
+}
+
+func (a *admin) InterceptSecured(_ network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return !a.banned(p, addrs.RemoteMultiaddr())
+}
+
+func (a *admin) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+func (a *admin) listReservations() []*reservationInfo {
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	list := make([]*reservationInfo, 0, len(a.reservations))
+	for p, r := range a.reservations {
+		if now.After(r.Expires) {
+			delete(a.reservations, p)
+			continue
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return list
+}
+
+func (a *admin) listCircuits() []*circuitInfo {
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.dropCircuits(func(c *circuitInfo) bool { return now.After(c.Expires) })
+	return append([]*circuitInfo{}, a.circuits...)
+}
+
+// dropCircuits removes the circuits matching drop, the lock must be held.
+func (a *admin) dropCircuits(drop func(*circuitInfo) bool) {
+	kept := a.circuits[:0]
+	for _, c := range a.circuits {
+		if !drop(c) {
+			kept = append(kept, c)
+		}
+	}
+	a.circuits = kept
+}
+
+func (a *admin) kick(p peer.ID) error {
+	log.Printf("kick peer %s", p)
+	return a.host.Network().ClosePeer(p)
+}
+
+func (a *admin) ban(p peer.ID, ip net.IP) {
+	a.lock.Lock()
+	if p != "" {
+		a.bannedPeers[p] = struct{}{}
+	}
+	if ip != nil {
+		a.bannedIPs[ip.String()] = struct{}{}
+	}
+	a.lock.Unlock()
+
+	// drop what is already connected
+	for _, conn := range a.host.Network().Conns() {
+		if a.banned(conn.RemotePeer(), conn.RemoteMultiaddr()) {
+			log.Printf("close banned connection from %s at %s", conn.RemotePeer(), conn.RemoteMultiaddr())
+			conn.Close()
+		}
+	}
+}
+
+func (a *admin) unban(p peer.ID, ip net.IP) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if p != "" {
+		delete(a.bannedPeers, p)
+	}
+	if ip != nil {
+		delete(a.bannedIPs, ip.String())
+	}
+}
+
+func (a *admin) listBans() *bans {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	list := &bans{Peers: []string{}, IPs: []string{}}
+	for p := range a.bannedPeers {
+		list.Peers = append(list.Peers, p.String())
+	}
+	for ip := range a.bannedIPs {
+		list.IPs = append(list.IPs, ip)
+	}
+	sort.Strings(list.Peers)
+	sort.Strings(list.IPs)
+	return list
+}
+
+// serveAdmin runs the admin API on addr. Every request needs the header
+// "Authorization: Bearer <token>".
+//
+//	GET  /reservations          reservations granted by the relay
+//	GET  /circuits              circuits allowed by the ACL, the relay may
+//	                            have refused some for its limits
+//	POST /kick?peer=<id>        close every connection of a peer
+//	GET  /bans                  banned peers and ips
+//	POST /ban?peer=<id>&ip=<ip> ban a peer and/or an ip
+//	POST /unban?peer=<id>&ip=<ip>
+//	POST /reload                reload the config file
+func serveAdmin(addr, token string, a *admin, reload func() error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reservations", a.handler(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return a.listReservations(), nil
+	}))
+	mux.HandleFunc("/circuits", a.handler(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return a.listCircuits(), nil
+	}))
+	mux.HandleFunc("/kick", a.handler(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		p, _, err := parseTargets(r, true)
+		if err != nil {
+			return nil, err
+		}
+		return nil, a.kick(p)
+	}))
+	mux.HandleFunc("/bans", a.handler(http.MethodGet, func(r *http.Request) (interface{}, error) {
+		return a.listBans(), nil
+	}))
+	mux.HandleFunc("/ban", a.handler(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		p, ip, err := parseTargets(r, false)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("ban peer %q ip %v", p, ip)
+		a.ban(p, ip)
+		return a.listBans(), nil
+	}))
+	mux.HandleFunc("/unban", a.handler(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		p, ip, err := parseTargets(r, false)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("unban peer %q ip %v", p, ip)
+		a.unban(p, ip)
+		return a.listBans(), nil
+	}))
+	mux.HandleFunc("/reload", a.handler(http.MethodPost, func(r *http.Request) (interface{}, error) {
+		return nil, reload()
+	}))
+
+	log.Printf("serve admin api on http://%s", addr)
+	if err := http.ListenAndServe(addr, requireToken(token, mux)); err != nil {
+		log.Printf("Failed to serve the admin api: %v", err)
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.Printf("refuse admin request from %s: bad token", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) handler(method string, handle func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := handle(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if result == nil {
+			result = map[string]string{"result": "ok"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// parseTargets reads the peer and ip query parameters, at least one of them
+// must be given.
+func parseTargets(r *http.Request, needPeer bool) (peer.ID, net.IP, error) {
+	var p peer.ID
+	if id := strings.TrimSpace(r.URL.Query().Get("peer")); len(id) > 0 {
+		var err error
+		if p, err = peer.Decode(id); err != nil {
+			return "", nil, fmt.Errorf("invalid peer id: %w", err)
+		}
+	}
+
+	var ip net.IP
+	if text := strings.TrimSpace(r.URL.Query().Get("ip")); len(text) > 0 {
+		if ip = net.ParseIP(text); ip == nil {
+			return "", nil, fmt.Errorf("invalid ip %q", text)
+		}
+	}
+
+	if p == "" && (needPeer || ip == nil) {
+		return "", nil, fmt.Errorf("missing peer")
+	}
+	return p, ip, nil
+}
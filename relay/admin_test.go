@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestAdminBans(t *testing.T) {
+	alice, _ := peer.Decode("12D3KooW9qaj35NgxHjtrH6uKEKKgE1iPhYjrKpTKnDh1mUeGCAh")
+	bob, _ := peer.Decode("12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca")
+	addr := ma.StringCast("/ip4/10.0.0.1/tcp/4001")
+
+	acl, _ := createACL(ACLConfig{})
+	a := createAdmin(acl, Limits{Duration: time.Minute, ReservationTTL: time.Hour})
+
+	if !a.AllowReserve(alice, addr) || !a.AllowConnect(bob, addr, alice) {
+		t.Fatalf("open relay should allow everyone")
+	}
+	if len(a.listReservations()) != 0 || len(a.listCircuits()) != 1 {
+		t.Errorf("only the relay grants reservations, the circuit should be tracked")
+	}
+
+	a.bannedIPs[net.ParseIP("10.0.0.1").String()] = struct{}{}
+	if a.AllowReserve(bob, addr) {
+		t.Errorf("banned ip should not reserve")
+	}
+	if !a.AllowReserve(bob, ma.StringCast("/ip4/10.0.0.2/tcp/4001")) {
+		t.Errorf("other ip should reserve")
+	}
+
+	a.bannedPeers[alice] = struct{}{}
+	if a.AllowConnect(bob, ma.StringCast("/ip4/10.0.0.2/tcp/4001"), alice) {
+		t.Errorf("circuit to a banned peer should be refused")
+	}
+
+	a.unban(alice, net.ParseIP("10.0.0.1"))
+	if list := a.listBans(); len(list.Peers) != 0 || len(list.IPs) != 0 {
+		t.Errorf("unban should clear the bans, got %+v", list)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for header, code := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/bans", nil)
+		if len(header) > 0 {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("authorization %q: got %d, want %d", header, w.Code, code)
+		}
+	}
+}
+
+func TestAdminReservations(t *testing.T) {
+	alice, _ := peer.Decode("12D3KooW9qaj35NgxHjtrH6uKEKKgE1iPhYjrKpTKnDh1mUeGCAh")
+	acl, _ := createACL(ACLConfig{})
+	a := createAdmin(acl, Limits{Duration: time.Minute, ReservationTTL: time.Hour})
+	delivered := make(chan peer.ID, 1)
+	a.onReserve = func(p peer.ID) { delivered <- p }
+
+	cm := a.trackReservations(&connmgr.NullConnMgr{})
+	cm.TagPeer(alice, "relay-v2-hop", 2)
+	if len(a.listReservations()) != 0 {
+		t.Fatalf("other tags should not record a reservation")
+	}
+
+	cm.TagPeer(alice, reservationTag, 10)
+	if list := a.listReservations(); len(list) != 1 || list[0].Peer != alice.String() {
+		t.Fatalf("granted reservation not recorded, got %v", list)
+	}
+	select {
+	case p := <-delivered:
+		if p != alice {
+			t.Errorf("delivered to %s", p)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("mailbox not delivered on reservation")
+	}
+
+	cm.UntagPeer(alice, reservationTag)
+	if len(a.listReservations()) != 0 {
+		t.Errorf("expired reservation still listed")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"gopkg.in/yaml.v3"
+)
+
+// Limits bound what the relay spends on each reservation and circuit.
+type Limits struct {
+	// Duration and Data reset a relayed connection once either is reached.
+	Duration time.Duration `yaml:"duration"`
+	Data     int64         `yaml:"data"`
+
+	ReservationTTL         time.Duration `yaml:"reservation_ttl"`
+	MaxReservations        int           `yaml:"max_reservations"`
+	MaxCircuits            int           `yaml:"max_circuits"`
+	BufferSize             int           `yaml:"buffer_size"`
+	MaxReservationsPerPeer int           `yaml:"max_reservations_per_peer"`
+	MaxReservationsPerIP   int           `yaml:"max_reservations_per_ip"`
+	MaxReservationsPerASN  int           `yaml:"max_reservations_per_asn"`
+}
+
+// Config is the relay configuration, read from a yaml file and overridden
+// by command line flags.
+type Config struct {
+	ListenAddrs []string `yaml:"listen_addrs"`
+	// AnnounceAddrs replace the listen addresses we tell peers about, for
+	// hosts behind a cloud NAT that don't know their public address.
+	AnnounceAddrs []string `yaml:"announce_addrs"`
+	// IdentityPath keeps the relay key so its peer ID survives restarts, a
+	// new ID is generated on every start when it is empty.
+	IdentityPath          string            `yaml:"identity_path"`
+	PrivateNetworkKeyPath string            `yaml:"private_network_key_path"`
+	LogLevels             map[string]string `yaml:"log_levels"`
+	Limits                Limits            `yaml:"limits"`
+	ACL                   ACLConfig         `yaml:"acl"`
+	// MetricsAddr is the host:port serving prometheus metrics on /metrics,
+	// metrics are off when it is empty.
+	MetricsAddr string `yaml:"metrics_addr"`
+	// AdminAddr is the host:port of the admin http api, which is off when it
+	// is empty. Every admin request must carry AdminToken as a bearer token.
+	AdminAddr  string           `yaml:"admin_addr"`
+	AdminToken string           `yaml:"admin_token"`
+	Mailbox    MailboxConfig    `yaml:"mailbox"`
+	Rendezvous RendezvousConfig `yaml:"rendezvous"`
+	// ShutdownTimeout is how long SIGINT or SIGTERM wait for open circuits
+	// and mailbox transfers before the host is closed.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+func defaultConfig() *Config {
+	resources := relay.DefaultResources()
+	return &Config{
+		ListenAddrs: []string{
+			"/ip4/0.0.0.0/tcp/7785",
+			"/ip4/0.0.0.0/udp/7786/quic",
+			"/ip4/0.0.0.0/udp/7786/quic-v1",
+			"/ip6/::0/tcp/5021",
+			"/ip6/::0/udp/5022/quic",
+			"/ip6/::0/udp/5022/quic-v1",
+		},
+		LogLevels: map[string]string{
+			"p2p-holepunch": "debug",
+			"peer":          "info",
+			"relay":         "debug",
+		},
+		Limits: Limits{
+			Duration:               resources.Limit.Duration,
+			Data:                   resources.Limit.Data,
+			ReservationTTL:         resources.ReservationTTL,
+			MaxReservations:        resources.MaxReservations,
+			MaxCircuits:            resources.MaxCircuits,
+			BufferSize:             resources.BufferSize,
+			MaxReservationsPerPeer: resources.MaxReservationsPerPeer,
+			MaxReservationsPerIP:   resources.MaxReservationsPerIP,
+			MaxReservationsPerASN:  resources.MaxReservationsPerASN,
+		},
+		// only used once a mailbox directory is set
+		Mailbox: MailboxConfig{
+			TTL:            7 * 24 * time.Hour,
+			MaxMessageSize: 64 << 20,
+			MaxPeerSize:    256 << 20,
+			MaxTotalSize:   4 << 30,
+		},
+		// only used once rendezvous is enabled
+		Rendezvous: RendezvousConfig{
+			MaxTTL:       2 * time.Hour,
+			MaxPeers:     256,
+			MaxNamespace: 1024,
+		},
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// loadConfig reads the yaml file at path over the defaults, an empty path
+// gives the defaults.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	if len(path) == 0 {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// parseFlags reads the config file named by -config, then applies the flags
+// given on the command line over it.
+func parseFlags(args []string) (*Config, error) {
+	defaults := defaultConfig()
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	configPath := fs.String("config", "", "yaml config file")
+	fs.String("listen", "", "comma separated multiaddrs to listen on")
+	fs.String("announce", "", "comma separated multiaddrs to announce instead of the listen ones")
+	fs.String("identity", "", "private key file, created on first start, keeps the relay ID stable")
+	fs.String("psk", "", "private network pre-shared key file, only peers holding it can connect")
+	fs.String("allow-peers", "", "comma separated peer IDs allowed to use the relay")
+	fs.String("allow-file", "", "file of peer IDs allowed to use the relay, reloaded when it changes")
+	fs.String("metrics", "", "host:port to serve prometheus metrics on, e.g. 127.0.0.1:9090")
+	fs.String("admin", "", "host:port to serve the admin api on, e.g. 127.0.0.1:9091")
+	fs.String("admin-token", "", "bearer token required by the admin api")
+	fs.String("mailbox", "", "directory keeping sealed files for offline peers, enables store-and-forward")
+	fs.Duration("mailbox-ttl", defaults.Mailbox.TTL, "drop files not delivered after this long, 0 keeps them")
+	fs.Bool("rendezvous", false, "let peers register under namespaces and discover each other")
+	fs.Duration("shutdown-timeout", defaults.ShutdownTimeout, "how long to wait for open circuits on SIGINT or SIGTERM, 0 closes at once")
+	fs.String("log-level", "", "comma separated subsystem=level pairs, e.g. relay=debug,peer=info")
+	fs.Duration("limit-duration", 0, "reset a relayed connection after this long")
+	fs.Int64("limit-data", 0, "reset a relayed connection after this many bytes in each direction")
+	fs.Duration("reservation-ttl", 0, "how long a reservation lasts before it must be refreshed")
+	fs.Int("max-reservations", 0, "maximum number of active reservations")
+	fs.Int("max-circuits", 0, "maximum number of open circuits per peer")
+	fs.Int("max-reservations-per-peer", 0, "maximum number of reservations from the same peer")
+	fs.Int("max-reservations-per-ip", 0, "maximum number of reservations from the same ip")
+	fs.Int("max-reservations-per-asn", 0, "maximum number of reservations from the same asn")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		value := f.Value.String()
+		switch f.Name {
+		case "config":
+		case "listen":
+			config.ListenAddrs = splitList(value)
+		case "announce":
+			config.AnnounceAddrs = splitList(value)
+		case "identity":
+			config.IdentityPath = value
+		case "psk":
+			config.PrivateNetworkKeyPath = value
+		case "allow-peers":
+			config.ACL.AllowPeers = splitList(value)
+		case "allow-file":
+			config.ACL.AllowFile = value
+		case "metrics":
+			config.MetricsAddr = value
+		case "admin":
+			config.AdminAddr = value
+		case "admin-token":
+			config.AdminToken = value
+		case "mailbox":
+			config.Mailbox.Dir = value
+		case "mailbox-ttl":
+			config.Mailbox.TTL = f.Value.(flag.Getter).Get().(time.Duration)
+		case "rendezvous":
+			config.Rendezvous.Enabled = f.Value.(flag.Getter).Get().(bool)
+		case "shutdown-timeout":
+			config.ShutdownTimeout = f.Value.(flag.Getter).Get().(time.Duration)
+		case "log-level":
+			for _, pair := range splitList(value) {
+				subsystem, level, ok := strings.Cut(pair, "=")
+				if !ok {
+					err = fmt.Errorf("invalid log level %q, want subsystem=level", pair)
+					return
+				}
+				config.LogLevels[subsystem] = level
+			}
+		default:
+			err = config.Limits.set(f.Name, f.Value.(flag.Getter).Get())
+		}
+	})
+	return config, err
+}
+
+func (l *Limits) set(name string, value interface{}) error {
+	switch name {
+	case "limit-duration":
+		l.Duration = value.(time.Duration)
+	case "limit-data":
+		l.Data = value.(int64)
+	case "reservation-ttl":
+		l.ReservationTTL = value.(time.Duration)
+	case "max-reservations":
+		l.MaxReservations = value.(int)
+	case "max-circuits":
+		l.MaxCircuits = value.(int)
+	case "max-reservations-per-peer":
+		l.MaxReservationsPerPeer = value.(int)
+	case "max-reservations-per-ip":
+		l.MaxReservationsPerIP = value.(int)
+	case "max-reservations-per-asn":
+		l.MaxReservationsPerASN = value.(int)
+	default:
+		return fmt.Errorf("unknown flag %s", name)
+	}
+	return nil
+}
+
+func (l *Limits) resources() relay.Resources {
+	return relay.Resources{
+		Limit: &relay.RelayLimit{
+			Duration: l.Duration,
+			Data:     l.Data,
+		},
+		ReservationTTL:         l.ReservationTTL,
+		MaxReservations:        l.MaxReservations,
+		MaxCircuits:            l.MaxCircuits,
+		BufferSize:             l.BufferSize,
+		MaxReservationsPerPeer: l.MaxReservationsPerPeer,
+		MaxReservationsPerIP:   l.MaxReservationsPerIP,
+		MaxReservationsPerASN:  l.MaxReservationsPerASN,
+	}
+}
+
+func (c *Config) applyLogLevels() error {
+	for subsystem, level := range c.LogLevels {
+		if err := logging.SetLogLevel(subsystem, level); err != nil {
+			return fmt.Errorf("set log level %s=%s: %w", subsystem, level, err)
+		}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	yaml := `
+listen_addrs:
+  - /ip4/0.0.0.0/tcp/4001
+identity_path: relay.key
+log_levels:
+  relay: info
+limits:
+  duration: 10m
+  max_reservations_per_ip: 2
+`
+	if err := os.WriteFile(path, []byte(yaml), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := parseFlags([]string{
+		"-config", path,
+		"-announce", "/ip4/203.0.113.10/tcp/4001",
+		"-limit-data", "1048576",
+		"-log-level", "peer=warn",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.ListenAddrs) != 1 || config.ListenAddrs[0] != "/ip4/0.0.0.0/tcp/4001" {
+		t.Errorf("unexpected listen addrs %v", config.ListenAddrs)
+	}
+	if len(config.AnnounceAddrs) != 1 || config.AnnounceAddrs[0] != "/ip4/203.0.113.10/tcp/4001" {
+		t.Errorf("unexpected announce addrs %v", config.AnnounceAddrs)
+	}
+	if config.IdentityPath != "relay.key" {
+		t.Errorf("unexpected identity path %s", config.IdentityPath)
+	}
+	if config.LogLevels["relay"] != "info" || config.LogLevels["peer"] != "warn" {
+		t.Errorf("unexpected log levels %v", config.LogLevels)
+	}
+
+	limits := config.Limits
+	if limits.Duration != 10*time.Minute || limits.Data != 1048576 || limits.MaxReservationsPerIP != 2 {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+	if limits.MaxReservationsPerPeer != 4 || limits.ReservationTTL != time.Hour {
+		t.Errorf("unset limits should keep the defaults %+v", limits)
+	}
+	if config.ShutdownTimeout != 30*time.Second {
+		t.Errorf("unexpected shutdown timeout %v", config.ShutdownTimeout)
+	}
+
+	path = filepath.Join(t.TempDir(), "typo.yaml")
+	os.WriteFile(path, []byte("listen_adrs: []\n"), 0666)
+	if _, err := parseFlags([]string{"-config", path}); err == nil {
+		t.Errorf("unknown config keys should be rejected")
+	}
+}
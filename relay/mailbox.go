@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"p2faster/peer"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const mailboxExpireInterval = 10 * time.Minute
+
+// MailboxConfig turns on store-and-forward: peers leave sealed files for
+// offline peers and the relay delivers them when those connect or reserve.
+// Files are end-to-end encrypted, the relay only sees sender, recipient and
+// size.
+type MailboxConfig struct {
+	// Dir keeps one directory of pending files per recipient, the mailbox
+	// is off when it is empty.
+	Dir            string        `yaml:"dir"`
+	TTL            time.Duration `yaml:"ttl"`
+	MaxMessageSize int64         `yaml:"max_message_size"`
+	MaxPeerSize    int64         `yaml:"max_peer_size"`
+	MaxTotalSize   int64         `yaml:"max_total_size"`
+}
+
+type mailbox struct {
+	config MailboxConfig
+	host   host.Host
+	allow  func(src libp2ppeer.ID, srcAddr ma.Multiaddr, dest libp2ppeer.ID) bool
+
+	// lock guards the quota check of uploads, the transfers in flight and
+	// closing
+	lock       sync.Mutex
+	delivering map[libp2ppeer.ID]bool
+	uploads    int
+	closing    bool
+	// reserved is the room held by the uploads in flight to each recipient
+	reserved map[libp2ppeer.ID]int64
+}
+
+func createMailbox(config MailboxConfig, allow func(libp2ppeer.ID, ma.Multiaddr, libp2ppeer.ID) bool) (*mailbox, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	// uploads cut by a restart are dropped, they hold no room anymore
+	parts, _ := filepath.Glob(filepath.Join(config.Dir, "*", "*.part"))
+	for _, part := range parts {
+		os.Remove(part)
+	}
+	return &mailbox{
+		config:     config,
+		allow:      allow,
+		delivering: make(map[libp2ppeer.ID]bool),
+		reserved:   make(map[libp2ppeer.ID]int64),
+	}, nil
+}
+
+// attach serves uploads on the relay host and delivers pending files to the
+// peers that connect.
+func (m *mailbox) attach(h host.Host) {
+	m.host = h
+	h.SetStreamHandler(peer.MailboxPutProtocol, m.onPut)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			go m.deliver(conn.RemotePeer())
+		},
+	})
+	go m.expire()
+}
+
+func (m *mailbox) onPut(s network.Stream) {
+	defer s.Close()
+
+	decoder := json.NewDecoder(s)
+	put := &peer.MailboxPut{}
+	if err := decoder.Decode(put); err != nil {
+		log.Printf("Failed to read a mailbox put: %v", err)
+		s.Reset()
+		return
+	}
+
+	m.lock.Lock()
+	if m.closing {
+		m.lock.Unlock()
+		s.Reset()
+		return
+	}
+	m.uploads++
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		m.uploads--
+		m.lock.Unlock()
+	}()
+
+	from := s.Conn().RemotePeer()
+	err := m.store(from, s.Conn().RemoteMultiaddr(), put.To, io.MultiReader(decoder.Buffered(), s))
+	result := &peer.MailboxResult{Code: peer.MailboxOk}
+	if err != nil {
+		log.Printf("refuse mailbox file from %s to %s: %v", from, put.To, err)
+		result = &peer.MailboxResult{Code: peer.MailboxFailed, Msg: err.Error()}
+	}
+	if err := json.NewEncoder(s).Encode(result); err != nil {
+		log.Printf("Failed to answer a mailbox put: %v", err)
+	}
+}
+
+func (m *mailbox) store(from libp2ppeer.ID, addr ma.Multiaddr, to string, r io.Reader) error {
+	dest, err := libp2ppeer.Decode(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+	if !m.allow(from, addr, dest) {
+		return fmt.Errorf("not allowed")
+	}
+
+	room := m.reserve(dest)
+	if room <= 0 {
+		return fmt.Errorf("mailbox full")
+	}
+	defer m.release(dest, room)
+
+	dir := filepath.Join(m.config.Dir, dest.String())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// names sort in arrival order, the .part suffix hides unfinished uploads
+	path := filepath.Join(dir, fmt.Sprintf("%020d-%s", time.Now().UnixNano(), from))
+	f, err := os.Create(path + ".part")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, room+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > room {
+		err = fmt.Errorf("file larger than the %d bytes left", room)
+	}
+	if err != nil {
+		os.Remove(path + ".part")
+		return err
+	}
+	if err := os.Rename(path+".part", path+".box"); err != nil {
+		return err
+	}
+	log.Printf("keep %d bytes from %s for %s", n, from, dest)
+
+	if m.host.Network().Connectedness(dest) == network.Connected {
+		go m.deliver(dest)
+	}
+	return nil
+}
+
+// reserve holds the room left for an upload to dest until release, so the
+// uploads in flight together stay within the quotas. It returns 0 when the
+// mailbox of dest is full.
+func (m *mailbox) reserve(dest libp2ppeer.ID) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	room := m.room(dest)
+	if room <= 0 {
+		return 0
+	}
+	m.reserved[dest] += room
+	return room
+}
+
+func (m *mailbox) release(dest libp2ppeer.ID, room int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.reserved[dest] -= room; m.reserved[dest] <= 0 {
+		delete(m.reserved, dest)
+	}
+}
+
+// room is how many bytes dest may still receive, the lock must be held.
+// Uploads in flight count for the room they reserved.
+func (m *mailbox) room(dest libp2ppeer.ID) int64 {
+	var reserved int64
+	for _, n := range m.reserved {
+		reserved += n
+	}
+	room := m.config.MaxMessageSize
+	if left := m.config.MaxPeerSize - dirSize(filepath.Join(m.config.Dir, dest.String())) - m.reserved[dest]; left < room {
+		room = left
+	}
+	if left := m.config.MaxTotalSize - dirSize(m.config.Dir) - reserved; left < room {
+		room = left
+	}
+	return room
+}
+
+// deliver sends the pending files of p in arrival order, and stops at the
+// first failure so the rest waits for the next connection or reservation.
+func (m *mailbox) deliver(p libp2ppeer.ID) {
+	m.lock.Lock()
+	if m.closing || m.delivering[p] {
+		m.lock.Unlock()
+		return
+	}
+	m.delivering[p] = true
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.delivering, p)
+		m.lock.Unlock()
+	}()
+
+	for _, path := range m.pending(p) {
+		if err := m.deliverFile(p, path); err != nil {
+			log.Printf("Failed to deliver %s to %s: %v", filepath.Base(path), p, err)
+			return
+		}
+	}
+}
+
+func (m *mailbox) deliverFile(p libp2ppeer.ID, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	s, err := m.host.NewStream(ctx, p, peer.MailboxDeliverProtocol)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	id := strings.TrimSuffix(filepath.Base(path), ".box")
+	if err := json.NewEncoder(s).Encode(&peer.MailboxDelivery{ID: id, Size: info.Size()}); err != nil {
+		s.Reset()
+		return err
+	}
+	if _, err := io.Copy(s, f); err != nil {
+		s.Reset()
+		return err
+	}
+	s.CloseWrite()
+
+	result := &peer.MailboxResult{}
+	if err := json.NewDecoder(s).Decode(result); err != nil {
+		return err
+	}
+	switch result.Code {
+	case peer.MailboxOk:
+		log.Printf("delivered %s to %s", id, p)
+	case peer.MailboxRejected:
+		log.Printf("%s rejected %s, drop it: %s", p, id, result.Msg)
+	default:
+		return fmt.Errorf("%s", result.Msg)
+	}
+	return os.Remove(path)
+}
+
+// close stops new uploads and deliveries, those in flight go on.
+func (m *mailbox) close() {
+	m.host.RemoveStreamHandler(peer.MailboxPutProtocol)
+	m.lock.Lock()
+	m.closing = true
+	m.lock.Unlock()
+}
+
+func (m *mailbox) idle() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.uploads == 0 && len(m.delivering) == 0
+}
+
+func (m *mailbox) pending(p libp2ppeer.ID) []string {
+	paths, err := filepath.Glob(filepath.Join(m.config.Dir, p.String(), "*.box"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// expire drops files older than the TTL, none when it is not set.
+func (m *mailbox) expire() {
+	if m.config.TTL <= 0 {
+		return
+	}
+	for range time.Tick(mailboxExpireInterval) {
+		deadline := time.Now().Add(-m.config.TTL)
+		filepath.Walk(m.config.Dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if info.ModTime().Before(deadline) {
+				log.Printf("drop expired mailbox file %s", path)
+				os.Remove(path)
+			}
+			return nil
+		})
+	}
+}
+
+// dirSize counts the files kept in dir, the uploads in flight count for
+// what they reserved instead.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.HasSuffix(path, ".part") {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
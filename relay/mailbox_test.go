@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestMailboxDefaults(t *testing.T) {
+	dir := t.TempDir()
+	config, err := parseFlags([]string{"-mailbox", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Mailbox.Dir != dir || config.Mailbox.TTL <= 0 {
+		t.Errorf("unexpected mailbox config %+v", config.Mailbox)
+	}
+
+	m, err := createMailbox(config.Mailbox, func(libp2ppeer.ID, ma.Multiaddr, libp2ppeer.ID) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := libp2ppeer.Decode("12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca")
+	if room := m.reserve(alice); room != config.Mailbox.MaxMessageSize {
+		t.Errorf("unexpected room %d", room)
+	}
+}
+
+func TestMailboxReserve(t *testing.T) {
+	dir := t.TempDir()
+	m, err := createMailbox(MailboxConfig{Dir: dir, MaxMessageSize: 100, MaxPeerSize: 150, MaxTotalSize: 1000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := libp2ppeer.Decode("12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca")
+
+	// concurrent uploads share the room of the recipient
+	first := m.reserve(alice)
+	second := m.reserve(alice)
+	if first != 100 || second != 50 || m.reserve(alice) != 0 {
+		t.Fatalf("unexpected rooms %d %d", first, second)
+	}
+	m.release(alice, second)
+
+	// a kept file counts, an upload in flight counts for what it reserved
+	os.MkdirAll(filepath.Join(dir, alice.String()), 0700)
+	os.WriteFile(filepath.Join(dir, alice.String(), "1.box"), make([]byte, 30), 0600)
+	os.WriteFile(filepath.Join(dir, alice.String(), "2.part"), make([]byte, 80), 0600)
+	if room := m.reserve(alice); room != 20 {
+		t.Errorf("unexpected room %d", room)
+	}
+}
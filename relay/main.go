@@ -2,49 +2,196 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"p2faster/peer"
+	"strings"
+	"syscall"
 
-	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 func main() {
-	run()
+	config, err := parseFlags(os.Args[1:])
+	if err != nil {
+		log.Printf("Failed to load the config: %v", err)
+		return
+	}
+
+	run(config)
 }
 
-func run() {
+func run(config *Config) {
+	if err := config.applyLogLevels(); err != nil {
+		log.Printf("Failed to set log levels: %v", err)
+	}
 
-	logging.SetLogLevel("p2p-holepunch", "debug")
-	logging.SetLogLevel("peer", "info")
-	logging.SetLogLevel("relay", "debug")
+	listenAddrs := config.ListenAddrs
 	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/7785",
-			"/ip4/0.0.0.0/udp/7786/quic",
-			"/ip4/0.0.0.0/udp/7786/quic-v1",
-			"/ip6/::0/tcp/5021",
-			"/ip6/::0/udp/5022/quic",
-			"/ip6/::0/udp/5022/quic-v1",
-		),
 		libp2p.EnableNATService(),
-		libp2p.EnableRelayService(),
 		libp2p.EnableRelay(),
-		libp2p.EnableHolePunching(),
 	}
+	var relayOpts []relay.Option
+	if len(config.MetricsAddr) > 0 {
+		hostOpts, metricsRelayOpts, err := metricsOptions()
+		if err != nil {
+			log.Printf("Failed to set up metrics: %v", err)
+			return
+		}
+		opts = append(opts, hostOpts...)
+		relayOpts = append(relayOpts, metricsRelayOpts...)
+	} else {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	if len(config.PrivateNetworkKeyPath) > 0 {
+		psk, err := peer.LoadPrivateNetworkKey(config.PrivateNetworkKeyPath)
+		if err != nil {
+			log.Printf("Failed to load the private network key: %v", err)
+			return
+		}
+		// quic can't run over a private network, only listen on tcp
+		listenAddrs = nil
+		for _, addr := range config.ListenAddrs {
+			if !strings.Contains(addr, "/quic") && !strings.Contains(addr, "/webtransport") {
+				listenAddrs = append(listenAddrs, addr)
+			}
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+		log.Printf("run in a private network, peers need the key in %s", config.PrivateNetworkKeyPath)
+	}
+	opts = append(opts, libp2p.ListenAddrStrings(listenAddrs...))
+
+	if len(config.IdentityPath) > 0 {
+		priv, err := peer.LoadIdentity(config.IdentityPath)
+		if err != nil {
+			log.Printf("Failed to load the identity: %v", err)
+			return
+		}
+		opts = append(opts, libp2p.Identity(priv))
+	}
+
+	if len(config.AnnounceAddrs) > 0 {
+		var announce []ma.Multiaddr
+		for _, addr := range config.AnnounceAddrs {
+			a, err := ma.NewMultiaddr(addr)
+			if err != nil {
+				log.Printf("Failed to parse the announce address %s: %v", addr, err)
+				return
+			}
+			announce = append(announce, a)
+		}
+		opts = append(opts, libp2p.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+			return announce
+		}))
+	}
+
+	acl, err := createACL(config.ACL)
+	if err != nil {
+		log.Printf("Failed to load the acl: %v", err)
+		return
+	}
+	admin := createAdmin(acl, config.Limits)
+	// same watermarks as the libp2p default connection manager
+	cm, err := connmgr.NewConnManager(160, 192)
+	if err != nil {
+		log.Printf("Failed to create the connection manager: %v", err)
+		return
+	}
+	opts = append(opts, libp2p.ConnectionGater(admin), libp2p.ConnectionManager(admin.trackReservations(cm)))
+
+	if len(config.AdminAddr) > 0 && len(config.AdminToken) == 0 {
+		log.Printf("Failed to start the admin api: admin_token is required")
+		return
+	}
+
 	host, err := libp2p.New(opts...)
 	if err != nil {
 		log.Printf("Failed to create relay1: %v", err)
 		return
 	}
 
-	_, err = relay.New(host)
+	admin.attach(host)
+	var mailbox *mailbox
+	if len(config.Mailbox.Dir) > 0 {
+		mailbox, err = createMailbox(config.Mailbox, admin.allowMailbox)
+		if err != nil {
+			log.Printf("Failed to open the mailbox: %v", err)
+			return
+		}
+		mailbox.attach(host)
+		admin.onReserve = mailbox.deliver
+		log.Printf("keep files for offline peers in %s", config.Mailbox.Dir)
+	}
+	if config.Rendezvous.Enabled {
+		createRendezvous(config.Rendezvous, admin.allowPeer).attach(host)
+	}
+
+	// the relay service is started here rather than with
+	// libp2p.EnableRelayService so it always runs with our limits
+	relayOpts = append(relayOpts, relay.WithResources(config.Limits.resources()), relay.WithACL(admin))
+	go acl.watch()
+	go reloadOnHangup(acl)
+	_, err = relay.New(host, relayOpts...)
 	if err != nil {
 		log.Printf("Failed to instantiate the relay: %v", err)
 		return
 	}
 
+	// serve the private p2faster dht so peers can find each other through us
+	_, err = dht.New(context.Background(), host, dht.Mode(dht.ModeServer), dht.ProtocolPrefix(peer.DhtProtocolPrefix))
+	if err != nil {
+		log.Printf("Failed to start the dht: %v", err)
+		return
+	}
+
 	log.Printf("relay1Info ID: %v Addrs: %v", host.ID(), host.Addrs())
 
-	select {}
+	if len(config.MetricsAddr) > 0 {
+		go serveMetrics(config.MetricsAddr)
+	}
+	if len(config.AdminAddr) > 0 {
+		go serveAdmin(config.AdminAddr, config.AdminToken, admin, func() error {
+			return reload(acl)
+		})
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	shutdown(host, admin, mailbox, config.ShutdownTimeout)
+}
+
+// reloadOnHangup reloads the config on SIGHUP.
+func reloadOnHangup(acl *aclFilter) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := reload(acl); err != nil {
+			log.Printf("Failed to reload the config: %v", err)
+		}
+	}
+}
+
+// reload reads the config file and flags again and applies the log levels
+// and the acl. Listen addresses, limits and keys only change on restart.
+func reload(acl *aclFilter) error {
+	config, err := parseFlags(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if err := config.applyLogLevels(); err != nil {
+		return err
+	}
+	if err := acl.update(config.ACL); err != nil {
+		return fmt.Errorf("reload the acl, keep the previous list: %w", err)
+	}
+	log.Printf("config reloaded, restart to apply listen addresses and limits")
+	return nil
 }
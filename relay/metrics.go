@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/libp2p/go-libp2p"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/host/resource-manager/obs"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsOptions reports the resource manager, relay and hole punching
+// metrics to the default prometheus registry. libp2p already registers the
+// swarm metrics there, which count connections per transport.
+func metricsOptions() ([]libp2p.Option, []relay.Option, error) {
+	obs.MustRegisterWith(prometheus.DefaultRegisterer)
+	reporter, err := obs.NewStatsTraceReporter()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// same limits as the libp2p default resource manager
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	mgr, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits.AutoScale()), rcmgr.WithTraceReporter(reporter))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostOpts := []libp2p.Option{
+		libp2p.ResourceManager(mgr),
+		libp2p.EnableHolePunching(holepunch.WithMetricsTracer(holepunch.NewMetricsTracer())),
+	}
+	relayOpts := []relay.Option{
+		relay.WithMetricsTracer(relay.NewMetricsTracer()),
+	}
+	return hostOpts, relayOpts, nil
+}
+
+// serveMetrics exposes the default prometheus registry on addr/metrics.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("serve metrics on http://%s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Failed to serve metrics: %v", err)
+	}
+}
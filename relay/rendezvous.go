@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"p2faster/peer"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// RendezvousConfig lets peers register under a namespace, such as
+// team-infra, and list the other members with their circuit addresses.
+type RendezvousConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxTTL caps the registration lifetime asked by peers.
+	MaxTTL       time.Duration `yaml:"max_ttl"`
+	MaxPeers     int           `yaml:"max_peers"`
+	MaxNamespace int           `yaml:"max_namespaces"`
+}
+
+type registration struct {
+	addrs   []string
+	expires time.Time
+}
+
+// rendezvous keeps the registrations in memory, they end when their TTL
+// passes or when the peer disconnects.
+type rendezvous struct {
+	config RendezvousConfig
+	self   libp2ppeer.ID
+	allow  func(libp2ppeer.ID, ma.Multiaddr) bool
+
+	lock       sync.Mutex
+	namespaces map[string]map[libp2ppeer.ID]*registration
+}
+
+func createRendezvous(config RendezvousConfig, allow func(libp2ppeer.ID, ma.Multiaddr) bool) *rendezvous {
+	return &rendezvous{
+		config:     config,
+		allow:      allow,
+		namespaces: make(map[string]map[libp2ppeer.ID]*registration),
+	}
+}
+
+func (r *rendezvous) attach(h host.Host) {
+	r.self = h.ID()
+	h.SetStreamHandler(peer.RendezvousProtocol, r.onStream)
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				r.remove(conn.RemotePeer())
+			}
+		},
+	})
+}
+
+func (r *rendezvous) onStream(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(30 * time.Second))
+
+	req := &peer.RendezvousRequest{}
+	if err := json.NewDecoder(s).Decode(req); err != nil {
+		log.Printf("Failed to read a rendezvous request: %v", err)
+		s.Reset()
+		return
+	}
+
+	resp, err := r.handle(s.Conn().RemotePeer(), s.Conn().RemoteMultiaddr(), req, time.Now())
+	if err != nil {
+		log.Printf("refuse rendezvous %s in %q from %s: %v", req.Type, req.Namespace, s.Conn().RemotePeer(), err)
+		resp = &peer.RendezvousResponse{Code: -1, Msg: err.Error()}
+	}
+	if err := json.NewEncoder(s).Encode(resp); err != nil {
+		log.Printf("Failed to answer a rendezvous request: %v", err)
+	}
+}
+
+func (r *rendezvous) handle(p libp2ppeer.ID, addr ma.Multiaddr, req *peer.RendezvousRequest, now time.Time) (*peer.RendezvousResponse, error) {
+	if !namespacePattern.MatchString(req.Namespace) {
+		return nil, fmt.Errorf("invalid namespace")
+	}
+	if !r.allow(p, addr) {
+		return nil, fmt.Errorf("not allowed")
+	}
+
+	switch req.Type {
+	case peer.RendezvousRegister:
+		ttl := time.Duration(req.TTL) * time.Second
+		if ttl <= 0 || ttl > r.config.MaxTTL {
+			ttl = r.config.MaxTTL
+		}
+		if err := r.register(req.Namespace, p, req.Addrs, now, ttl); err != nil {
+			return nil, err
+		}
+		return &peer.RendezvousResponse{TTL: int64(ttl / time.Second)}, nil
+	case peer.RendezvousUnregister:
+		r.unregister(req.Namespace, p)
+		return &peer.RendezvousResponse{}, nil
+	case peer.RendezvousDiscover:
+		return &peer.RendezvousResponse{Peers: r.discover(req.Namespace, now)}, nil
+	default:
+		return nil, fmt.Errorf("unknown request %q", req.Type)
+	}
+}
+
+func (r *rendezvous) register(namespace string, p libp2ppeer.ID, addrs []string, now time.Time, ttl time.Duration) error {
+	// only keep the addresses that parse, and put our circuit address first
+	// since it works for peers behind any NAT
+	valid := []string{"/p2p/" + r.self.String() + "/p2p-circuit/p2p/" + p.String()}
+	for _, addr := range addrs {
+		if _, err := ma.NewMultiaddr(addr); err == nil && len(valid) < 16 {
+			valid = append(valid, addr)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prune(now)
+	members, ok := r.namespaces[namespace]
+	if !ok {
+		if len(r.namespaces) >= r.config.MaxNamespace {
+			return fmt.Errorf("too many namespaces")
+		}
+		members = make(map[libp2ppeer.ID]*registration)
+		r.namespaces[namespace] = members
+	}
+	if _, ok := members[p]; !ok && len(members) >= r.config.MaxPeers {
+		return fmt.Errorf("namespace full")
+	}
+	members[p] = &registration{addrs: valid, expires: now.Add(ttl)}
+	return nil
+}
+
+func (r *rendezvous) unregister(namespace string, p libp2ppeer.ID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if members, ok := r.namespaces[namespace]; ok {
+		delete(members, p)
+		if len(members) == 0 {
+			delete(r.namespaces, namespace)
+		}
+	}
+}
+
+// remove drops every registration of p.
+func (r *rendezvous) remove(p libp2ppeer.ID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for namespace, members := range r.namespaces {
+		delete(members, p)
+		if len(members) == 0 {
+			delete(r.namespaces, namespace)
+		}
+	}
+}
+
+// prune drops the expired registrations, the lock must be held.
+func (r *rendezvous) prune(now time.Time) {
+	for namespace, members := range r.namespaces {
+		for p, reg := range members {
+			if now.After(reg.expires) {
+				delete(members, p)
+			}
+		}
+		if len(members) == 0 {
+			delete(r.namespaces, namespace)
+		}
+	}
+}
+
+// discover lists the live members of namespace.
+func (r *rendezvous) discover(namespace string, now time.Time) []peer.NamespacePeer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prune(now)
+
+	peers := []peer.NamespacePeer{}
+	for p, reg := range r.namespaces[namespace] {
+		peers = append(peers, peer.NamespacePeer{ID: p.String(), Addrs: reg.addrs})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
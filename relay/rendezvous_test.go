@@ -0,0 +1,81 @@
+package main
+
+import (
+	"p2faster/peer"
+	"testing"
+	"time"
+
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestRendezvous(t *testing.T) {
+	relayId, _ := libp2ppeer.Decode("12D3KooW9qaj35NgxHjtrH6uKEKKgE1iPhYjrKpTKnDh1mUeGCAh")
+	alice, _ := libp2ppeer.Decode("12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca")
+	bob, _ := libp2ppeer.Decode("12D3KooWCfnnsj5gZLP9ruXTxQa3Ew3J4KktnuYpoRxnWFQGdaGn")
+
+	r := createRendezvous(RendezvousConfig{MaxTTL: time.Hour, MaxPeers: 1, MaxNamespace: 1}, func(p libp2ppeer.ID, _ ma.Multiaddr) bool {
+		return p != bob
+	})
+	r.self = relayId
+	now := time.Now()
+
+	resp, err := r.handle(alice, nil, &peer.RendezvousRequest{Type: peer.RendezvousRegister, Namespace: "team-infra", TTL: 7200, Addrs: []string{"/ip4/10.0.0.1/tcp/4001", "bad"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TTL != 3600 {
+		t.Errorf("ttl should be capped to an hour, got %d", resp.TTL)
+	}
+
+	resp, err = r.handle(alice, nil, &peer.RendezvousRequest{Type: peer.RendezvousDiscover, Namespace: "team-infra"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/p2p/" + relayId.String() + "/p2p-circuit/p2p/" + alice.String()
+	if len(resp.Peers) != 1 || len(resp.Peers[0].Addrs) != 2 || resp.Peers[0].Addrs[0] != want {
+		t.Errorf("unexpected members %+v", resp.Peers)
+	}
+
+	if _, err := r.handle(alice, nil, &peer.RendezvousRequest{Type: peer.RendezvousRegister, Namespace: "Team Infra"}, now); err == nil {
+		t.Errorf("invalid namespace should be refused")
+	}
+	if _, err := r.handle(bob, nil, &peer.RendezvousRequest{Type: peer.RendezvousDiscover, Namespace: "team-infra"}, now); err == nil {
+		t.Errorf("peer refused by the acl should not discover")
+	}
+	if _, err := r.handle(alice, nil, &peer.RendezvousRequest{Type: peer.RendezvousRegister, Namespace: "team-web"}, now); err == nil {
+		t.Errorf("namespace limit should be enforced")
+	}
+
+	resp, _ = r.handle(alice, nil, &peer.RendezvousRequest{Type: peer.RendezvousDiscover, Namespace: "team-infra"}, now.Add(2*time.Hour))
+	if len(resp.Peers) != 0 {
+		t.Errorf("expired registration should be dropped")
+	}
+}
+
+func TestRendezvousDefaults(t *testing.T) {
+	config, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Rendezvous.Enabled {
+		t.Errorf("rendezvous should be off unless asked")
+	}
+
+	config, err = parseFlags([]string{"-rendezvous"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Rendezvous.Enabled {
+		t.Fatalf("rendezvous should be on")
+	}
+	alice, _ := libp2ppeer.Decode("12D3KooWSZoaavzgnJ4dNJaraJspT1Kp6M3CAvJUfjdjXiDr6Uca")
+	r := createRendezvous(config.Rendezvous, func(libp2ppeer.ID, ma.Multiaddr) bool { return true })
+	resp, err := r.handle(alice, nil, &peer.RendezvousRequest{Type: peer.RendezvousRegister, Namespace: "team-infra"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TTL <= 0 {
+		t.Errorf("unexpected ttl %d", resp.TTL)
+	}
+}
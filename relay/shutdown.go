@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+)
+
+// shutdown stops new reservations, circuits and mailbox uploads, waits up to
+// timeout for the open circuits and mailbox transfers, then closes the host,
+// which tells every connected peer the relay is gone.
+func shutdown(h host.Host, a *admin, m *mailbox, timeout time.Duration) {
+	log.Printf("shutting down, wait up to %v for open circuits", timeout)
+	a.drain()
+	if m != nil {
+		m.close()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		circuits := openCircuits(h)
+		busy := m != nil && !m.idle()
+		if circuits == 0 && !busy {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("close with %d circuits still open", circuits)
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	if err := h.Close(); err != nil {
+		log.Printf("Failed to close the host: %v", err)
+	}
+	log.Printf("relay stopped")
+}
+
+// openCircuits counts the relayed connections going through us, each one is
+// a hop stream from the source peer.
+func openCircuits(h host.Host) int {
+	count := 0
+	for _, conn := range h.Network().Conns() {
+		for _, s := range conn.GetStreams() {
+			if s.Protocol() == proto.ProtoIDv2Hop && s.Stat().Direction == network.DirInbound {
+				count++
+			}
+		}
+	}
+	return count
+}